@@ -0,0 +1,72 @@
+package getconf
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// DeprecationWarning is emitted every time a value is supplied to an option
+// through one of its deprecated names.
+type DeprecationWarning struct {
+	Name        string    // deprecated name that supplied the value
+	Replacement string    // canonical name of the option
+	Source      string    // loader that supplied the value: env, flag, kvstore, user
+	Time        time.Time // when the value was supplied
+}
+
+// String implements Stringer
+func (w DeprecationWarning) String() string {
+	return fmt.Sprintf("getconf: option %q is deprecated, use %q instead (set by %s)", w.Name, w.Replacement, w.Source)
+}
+
+// deprecationHandler receives the deprecation warnings. By default they are logged, so they
+// do not mix with the output of the program.
+var deprecationHandler = func(w DeprecationWarning) {
+	log.Print(w.String())
+}
+
+// SetDeprecationHandler sets the function that will receive a DeprecationWarning every time a
+// deprecated name supplies a value. Passing nil silences the warnings.
+func SetDeprecationHandler(f func(DeprecationWarning)) {
+	if f == nil {
+		f = func(DeprecationWarning) {}
+	}
+	deprecationHandler = f
+}
+
+// resolveKey returns the canonical option name for key. If key is not an alias nor a
+// deprecated name, it is returned unchanged.
+func (gc *GetConf) resolveKey(key string) string {
+	if _, ok := gc.options[key]; ok {
+		return key
+	}
+	if canonical, ok := gc.aliases[key]; ok {
+		return canonical
+	}
+	return key
+}
+
+// warnIfDeprecated emits a DeprecationWarning if name is a deprecated name of an option.
+func (gc *GetConf) warnIfDeprecated(name, setBy string) {
+	canonical, ok := gc.aliases[name]
+	if !ok {
+		return
+	}
+	for _, d := range gc.options[canonical].deprecated {
+		if d == name {
+			deprecationHandler(DeprecationWarning{
+				Name:        name,
+				Replacement: canonical,
+				Source:      setBy,
+				Time:        time.Now().UTC(),
+			})
+			return
+		}
+	}
+}
+
+// altNames returns the alias and deprecated names of o, in that order.
+func (o *Option) altNames() []string {
+	return append(append([]string{}, o.aliases...), o.deprecated...)
+}
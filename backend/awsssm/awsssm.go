@@ -0,0 +1,433 @@
+package awsssm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/jllopis/getconf/backend"
+)
+
+var (
+	// ErrMultipleEndpointsUnsupported is thrown when there are
+	// multiple endpoints specified for SSM
+	ErrMultipleEndpointsUnsupported = errors.New("awsssm does not support multiple endpoints")
+
+	defaultWatchTimeDuration = 30 * time.Second
+)
+
+func init() {
+	backend.Register("awsssm", func(endpoints []string, cnf *backend.Config) (backend.Backend, error) {
+		return New(endpoints, cnf)
+	})
+}
+
+// Options holds the AWS specific options
+type Options struct {
+	Region   string // region of the service. Defaults to the one of the environment
+	Endpoint string // URL of the service. Defaults to the one of the region
+	// Credentials to sign the requests. Defaults to the credentials chain of the SDK:
+	// environment, shared files, ECS task role or EC2 instance role
+	Credentials aws.CredentialsProvider
+}
+
+// SSMBackend reads the parameters of the AWS Systems Manager Parameter Store.
+//
+// Every key is the parameter with the same path: "settings/gcv2/v1/store/host" is the parameter
+// "/settings/gcv2/v1/store/host". SecureString parameters are decrypted and the version of the
+// parameter is used as LastIndex.
+//
+// Secrets Manager secrets can be read with Get through their Parameter Store reference,
+// "aws/reference/secretsmanager/<secret>".
+type SSMBackend struct {
+	sync.Mutex
+	client    *ssm.Client
+	watchTime time.Duration
+	prefix    string
+	bucket    string
+}
+
+// New create a Parameter Store client with the provided options. It returns the created Backend
+// or an error.
+//
+// The endpoint can be empty, a region or the URL of the service with the region as a query param:
+//
+//	http://localhost:4566?region=eu-west-1
+func New(endpoints []string, cnf *backend.Config) (*SSMBackend, error) {
+	if len(endpoints) > 1 {
+		return nil, ErrMultipleEndpointsUnsupported
+	}
+	opts := Options{}
+	if len(endpoints) == 1 && endpoints[0] != "" {
+		if !strings.Contains(endpoints[0], "://") {
+			opts.Region = endpoints[0]
+		} else {
+			u, err := url.Parse(endpoints[0])
+			if err != nil {
+				return nil, err
+			}
+			opts.Region = u.Query().Get("region")
+			u.RawQuery = ""
+			opts.Endpoint = u.String()
+		}
+	}
+	return NewWithOptions(opts, cnf)
+}
+
+// NewWithOptions create a Parameter Store client with the provided options
+func NewWithOptions(opts Options, cnf *backend.Config) (*SSMBackend, error) {
+	s := &SSMBackend{watchTime: defaultWatchTimeDuration}
+	httpClient := awshttp.NewBuildableClient()
+	var loadOpts []func(*config.LoadOptions) error
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(opts.Region))
+	}
+	if opts.Credentials != nil {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(opts.Credentials))
+	}
+
+	// Set options
+	if cnf != nil {
+		s.prefix = cnf.Prefix
+		s.bucket = cnf.Bucket
+		tlsConfig := cnf.TLS
+		if tlsConfig == nil && cnf.ClientTLS != nil {
+			var err error
+			if tlsConfig, err = cnf.ClientTLS.TLSConfig(); err != nil {
+				return nil, err
+			}
+		}
+		if tlsConfig != nil {
+			httpClient = httpClient.WithTransportOptions(func(tr *http.Transport) {
+				tr.TLSClientConfig = tlsConfig
+			})
+		}
+		if cnf.ConnectionTimeout != 0 {
+			httpClient = httpClient.WithTimeout(cnf.ConnectionTimeout)
+		}
+	}
+	loadOpts = append(loadOpts, config.WithHTTPClient(httpClient))
+
+	awsConfig, err := config.LoadDefaultConfig(context.Background(), loadOpts...)
+	if err != nil {
+		return nil, err
+	}
+	s.client = ssm.NewFromConfig(awsConfig, func(o *ssm.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+	})
+
+	return s, nil
+}
+
+// GetPrefix return the defined prefix in the backend
+func (s *SSMBackend) GetPrefix() string { return s.prefix }
+
+// GetBucket return the defined bucket in the backend
+func (s *SSMBackend) GetBucket() string { return s.bucket }
+
+// SetWatchTimeDuration sets the interval used to poll the parameters
+func (s *SSMBackend) SetWatchTimeDuration(time time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.watchTime = time
+}
+
+func (s *SSMBackend) watchTimeDuration() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.watchTime
+}
+
+// name returns the parameter name of key. Empty elements are removed as they are not allowed.
+func name(key string) string {
+	elems := []string{}
+	for _, e := range strings.Split(key, "/") {
+		if e != "" {
+			elems = append(elems, e)
+		}
+	}
+	return "/" + strings.Join(elems, "/")
+}
+
+// Exists return true if key exists in backend and false otherwise
+func (s *SSMBackend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Get(ctx, key)
+	if err != nil {
+		if err == backend.ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Get a value given its key
+// It is safe to provide a timeout by using context.Timeout.
+func (s *SSMBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := s.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(aws.ToString(p.Value)), nil
+}
+
+func (s *SSMBackend) get(ctx context.Context, key string) (*types.Parameter, error) {
+	out, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name(key)),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		var nf *types.ParameterNotFound
+		if errors.As(err, &nf) {
+			return nil, backend.ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return out.Parameter, nil
+}
+
+// Put sets the value of key. New parameters are created as String and the type of the
+// existing ones is kept. TTLs are not supported.
+func (s *SSMBackend) Put(ctx context.Context, key string, value []byte, opts *backend.WriteOptions) error {
+	if opts != nil && opts.TTL != 0 {
+		return backend.ErrNotSupported
+	}
+	_, err := s.create(ctx, key, value)
+	if err != backend.ErrKeyExists {
+		return err
+	}
+	_, err = s.client.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(name(key)),
+		Value:     aws.String(string(value)),
+		Overwrite: aws.Bool(true),
+	})
+	return err
+}
+
+// create creates the String parameter of key and returns its version. It returns ErrKeyExists
+// if the parameter exists.
+func (s *SSMBackend) create(ctx context.Context, key string, value []byte) (int64, error) {
+	out, err := s.client.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:  aws.String(name(key)),
+		Value: aws.String(string(value)),
+		Type:  types.ParameterTypeString,
+	})
+	if err != nil {
+		var exists *types.ParameterAlreadyExists
+		if errors.As(err, &exists) {
+			return 0, backend.ErrKeyExists
+		}
+		return 0, err
+	}
+	return out.Version, nil
+}
+
+// Delete removes the parameter of key. Deleting a key that does not exist is not an error.
+func (s *SSMBackend) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(name(key))})
+	var nf *types.ParameterNotFound
+	if errors.As(err, &nf) {
+		return nil
+	}
+	return err
+}
+
+// DeleteTree removes all the parameters under the path directory
+func (s *SSMBackend) DeleteTree(ctx context.Context, directory string) error {
+	pairs, err := s.list(ctx, directory)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(pairs))
+	for i, p := range pairs {
+		names[i] = name(p.Key)
+	}
+	// DeleteParameters accepts up to 10 names
+	for len(names) > 0 {
+		n := 10
+		if len(names) < n {
+			n = len(names)
+		}
+		if _, err := s.client.DeleteParameters(ctx, &ssm.DeleteParametersInput{Names: names[:n]}); err != nil {
+			return err
+		}
+		names = names[n:]
+	}
+	return nil
+}
+
+// AtomicPut creates the String parameter of key only if it does not exist when previous is nil.
+// Parameter Store cannot compare versions on write so updating a previous keypair is not
+// supported, neither are TTLs.
+func (s *SSMBackend) AtomicPut(ctx context.Context, key string, value []byte, previous *backend.KVPair, opts *backend.WriteOptions) (bool, *backend.KVPair, error) {
+	if previous != nil || (opts != nil && opts.TTL != 0) {
+		return false, nil, backend.ErrNotSupported
+	}
+	version, err := s.create(ctx, key, value)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, &backend.KVPair{Key: strings.Trim(key, "/"), Value: value, LastIndex: uint64(version)}, nil
+}
+
+// AtomicDelete is not supported as Parameter Store cannot compare versions on delete
+func (s *SSMBackend) AtomicDelete(ctx context.Context, key string, previous *backend.KVPair) (bool, error) {
+	return false, backend.ErrNotSupported
+}
+
+// List will get all keypairs under a prefix
+// It is safe to provide a timeout by using context.Timeout.
+func (s *SSMBackend) List(ctx context.Context, key string) ([]*backend.KVPair, error) {
+	pairs, err := s.list(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+// list returns the parameters under the path key sorted by key. The keys are built from key so
+// they keep its layout.
+func (s *SSMBackend) list(ctx context.Context, key string) ([]*backend.KVPair, error) {
+	path := name(key)
+	base := strings.Trim(key, "/")
+	ret := []*backend.KVPair{}
+	paginator := ssm.NewGetParametersByPathPaginator(s.client, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range out.Parameters {
+			rel := strings.TrimPrefix(strings.TrimPrefix(aws.ToString(p.Name), path), "/")
+			ret = append(ret, &backend.KVPair{
+				Key:       strings.TrimPrefix(base+"/"+rel, "/"),
+				Value:     []byte(aws.ToString(p.Value)),
+				LastIndex: uint64(p.Version),
+			})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret, nil
+}
+
+// Watch listens for changes on a "key"
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current value will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// The parameter is polled every SetWatchTimeDuration and sent when its version or value changes.
+func (s *SSMBackend) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	current, err := s.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	respChan := make(chan []byte)
+	go func() {
+		defer close(respChan)
+		p := current
+		for {
+			select {
+			case respChan <- []byte(aws.ToString(p.Value)):
+			case <-ctx.Done():
+				return
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(s.watchTimeDuration()):
+				}
+				n, err := s.get(ctx, key)
+				if err == backend.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					return
+				}
+				// a deleted and recreated parameter starts again at version 1, so the value is compared too
+				if n.Version != p.Version || aws.ToString(n.Value) != aws.ToString(p.Value) {
+					p = n
+					break
+				}
+			}
+		}
+	}()
+	return respChan, nil
+}
+
+// WatchTree listens for changes on a "tree".
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current values will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// The tree is polled every SetWatchTimeDuration and all its keypairs are sent when the version
+// or the value of any parameter changes.
+func (s *SSMBackend) WatchTree(ctx context.Context, directory string) (<-chan []*backend.KVPair, error) {
+	current, err := s.list(ctx, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	respCh := make(chan []*backend.KVPair)
+	go func() {
+		defer close(respCh)
+		pairs := current
+		for {
+			select {
+			case respCh <- pairs:
+			case <-ctx.Done():
+				return
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(s.watchTimeDuration()):
+				}
+				p, err := s.list(ctx, directory)
+				if err != nil {
+					return
+				}
+				if !samePairs(p, pairs) {
+					pairs = p
+					break
+				}
+			}
+		}
+	}()
+	return respCh, nil
+}
+
+// samePairs returns true if a and b hold the same keys with the same versions and values
+func samePairs(a, b []*backend.KVPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].LastIndex != b[i].LastIndex || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,259 @@
+package awsssm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSSM is a Parameter Store answering GetParameter, GetParametersByPath, PutParameter,
+// DeleteParameter and DeleteParameters
+type fakeSSM struct {
+	sync.Mutex
+	*httptest.Server
+	params map[string]*fakeParam
+}
+
+type fakeParam struct {
+	Name    string
+	Type    string
+	Value   string
+	Version int64
+}
+
+func newFakeSSM(t *testing.T) *fakeSSM {
+	f := &fakeSSM{params: make(map[string]*fakeParam)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSSM) serve(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKID/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var in struct {
+		Name           string
+		Names          []string
+		Value          string
+		Type           string
+		Overwrite      bool
+		Path           string
+		Recursive      bool
+		WithDecryption bool
+		NextToken      string
+	}
+	json.NewDecoder(r.Body).Decode(&in)
+	// SecureString values are only sent decrypted
+	value := func(p *fakeParam) map[string]interface{} {
+		v := p.Value
+		if p.Type == "SecureString" && !in.WithDecryption {
+			v = "encrypted"
+		}
+		return map[string]interface{}{"Name": p.Name, "Type": p.Type, "Value": v, "Version": p.Version}
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "AmazonSSM.GetParameter":
+		p, ok := f.params[in.Name]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ParameterNotFound", "message": in.Name})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Parameter": value(p)})
+	case "AmazonSSM.GetParametersByPath":
+		names := []string{}
+		for n := range f.params {
+			if strings.HasPrefix(n, strings.TrimSuffix(in.Path, "/")+"/") {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		// pages of two parameters
+		start, _ := strconv.Atoi(in.NextToken)
+		out := map[string]interface{}{}
+		params := []interface{}{}
+		for i := start; i < len(names) && i < start+2; i++ {
+			params = append(params, value(f.params[names[i]]))
+		}
+		if start+2 < len(names) {
+			out["NextToken"] = strconv.Itoa(start + 2)
+		}
+		out["Parameters"] = params
+		json.NewEncoder(w).Encode(out)
+	case "AmazonSSM.PutParameter":
+		p, ok := f.params[in.Name]
+		switch {
+		case ok && !in.Overwrite:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ParameterAlreadyExists", "message": in.Name})
+			return
+		case !ok && in.Type == "":
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ValidationException", "message": "type required"})
+			return
+		case !ok:
+			p = &fakeParam{Name: in.Name, Type: in.Type}
+			f.params[in.Name] = p
+		}
+		p.Value = in.Value
+		p.Version++
+		json.NewEncoder(w).Encode(map[string]interface{}{"Version": p.Version})
+	case "AmazonSSM.DeleteParameter":
+		if _, ok := f.params[in.Name]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ParameterNotFound", "message": in.Name})
+			return
+		}
+		delete(f.params, in.Name)
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	case "AmazonSSM.DeleteParameters":
+		if len(in.Names) > 10 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ValidationException", "message": "too many names"})
+			return
+		}
+		for _, n := range in.Names {
+			delete(f.params, n)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"DeletedParameters": in.Names})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeSSM) put(name, typ, value string) {
+	f.Lock()
+	defer f.Unlock()
+	p, ok := f.params[name]
+	if !ok {
+		p = &fakeParam{Name: name}
+		f.params[name] = p
+	}
+	p.Type, p.Value = typ, value
+	p.Version++
+}
+
+func newTestBackend(t *testing.T, f *fakeSSM) *SSMBackend {
+	s, err := NewWithOptions(Options{
+		Region:      "eu-west-1",
+		Endpoint:    f.URL,
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}, &backend.Config{ConnectionTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	return s
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		s := newTestBackend(t, newFakeSSM(t))
+		s.SetWatchTimeDuration(10 * time.Millisecond)
+		return &backendtest.Store{Backend: s, NoVersions: true}
+	})
+}
+
+func TestParameters(t *testing.T) {
+	f := newFakeSSM(t)
+	f.put("/settings/apps/test/v1/port", "String", "8000")
+	f.put("/settings/apps/test/v1/port", "String", "8080")
+	f.put("/settings/apps/test/v1/store/host", "String", "db.local")
+	f.put("/settings/apps/test/v1/store/password", "SecureString", "s3cr3t")
+	f.put("/settings/apps/test_v1/port", "String", "9000")
+	s := newTestBackend(t, f)
+	ctx := context.Background()
+
+	v, err := s.Get(ctx, "/settings/apps/test/v1/store/password")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", string(v))
+
+	// the keys keep the layout of the requested one
+	pairs, err := s.List(ctx, "/settings/apps/test//v1")
+	require.NoError(t, err)
+	require.Len(t, pairs, 3)
+	assert.Equal(t, "settings/apps/test//v1/port", pairs[0].Key)
+	assert.Equal(t, uint64(2), pairs[0].LastIndex)
+	assert.Equal(t, "s3cr3t", string(pairs[2].Value))
+}
+
+func TestWrites(t *testing.T) {
+	f := newFakeSSM(t)
+	f.put("/app/v1/password", "SecureString", "s3cr3t")
+	s := newTestBackend(t, f)
+	ctx := context.Background()
+
+	require.NoError(t, s.Put(ctx, "app/v1/port", []byte("80"), nil))
+	require.NoError(t, s.Put(ctx, "app/v1/port", []byte("8080"), nil))
+	require.NoError(t, s.Put(ctx, "app/v1/password", []byte("n3w"), nil))
+	assert.Equal(t, int64(2), f.params["/app/v1/port"].Version)
+	assert.Equal(t, "SecureString", f.params["/app/v1/password"].Type)
+	assert.Equal(t, backend.ErrNotSupported, s.Put(ctx, "app/v1/port", []byte("80"), &backend.WriteOptions{TTL: time.Minute}))
+
+	ok, pair, err := s.AtomicPut(ctx, "/app/v1/host", []byte("localhost"), nil, nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), pair.LastIndex)
+
+	// the parameters are deleted in batches of ten
+	for i := 0; i < 12; i++ {
+		f.put("/app/v2/key"+strconv.Itoa(i), "String", "v")
+	}
+	require.NoError(t, s.DeleteTree(ctx, "app/v2"))
+	_, err = s.List(ctx, "app/v2")
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+	pairs, err := s.List(ctx, "app")
+	require.NoError(t, err)
+	assert.Len(t, pairs, 3)
+}
+
+func TestWatchRecreated(t *testing.T) {
+	f := newFakeSSM(t)
+	f.put("/app/v1/host", "String", "old")
+	s := newTestBackend(t, f)
+	s.SetWatchTimeDuration(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := s.Watch(ctx, "app/v1/host")
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(<-ch))
+	tree, err := s.WatchTree(ctx, "app/v1")
+	require.NoError(t, err)
+	assert.Len(t, <-tree, 1)
+
+	// the recreated parameter has the same version than the deleted one
+	f.Lock()
+	delete(f.params, "/app/v1/host")
+	f.Unlock()
+	f.put("/app/v1/host", "String", "new")
+	select {
+	case v := <-ch:
+		assert.Equal(t, "new", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+	select {
+	case pairs := <-tree:
+		require.Len(t, pairs, 1)
+		assert.Equal(t, "new", string(pairs[0].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
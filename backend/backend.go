@@ -3,12 +3,27 @@ package backend
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"io/ioutil"
 	"time"
 )
 
 var (
 	ErrKeyNotFound = errors.New("key not found")
+	// ErrKeyModified is returned by AtomicPut and AtomicDelete when the key has changed since the
+	// previous keypair was read
+	ErrKeyModified = errors.New("unable to complete atomic operation, key modified")
+	// ErrKeyExists is returned by AtomicPut when no previous keypair is given and the key exists
+	ErrKeyExists = errors.New("key already exists")
+	// ErrPreviousNotSpecified is returned by AtomicDelete when no previous keypair is given
+	ErrPreviousNotSpecified = errors.New("previous keypair must be specified")
+	// ErrNotSupported is returned by the Backends that cannot perform an operation, like the
+	// writes on a read only store
+	ErrNotSupported = errors.New("operation not supported by the backend")
+	// ErrTxnTooLarge is returned by PutMany when the keys exceed what the Backend can write in a
+	// single transaction. Nothing is written.
+	ErrTxnTooLarge = errors.New("too many keys for a single transaction")
 )
 
 // Backend defines the interface that every Backend should implement
@@ -30,23 +45,98 @@ type Backend interface {
 	// You can stop by using a context.Cancel when calling the method.
 	WatchTree(ctx context.Context, directory string) (<-chan []*KVPair, error)
 	// Exists return true if key exists in backend and false otherwise
-	Exists(key string) (bool, error)
+	// It is safe to provide a timeout by using context.Timeout.
+	Exists(ctx context.Context, key string) (bool, error)
 	// SetWatchTimeDuration sets the wait time for a watch connection to Backend
 	SetWatchTimeDuration(time time.Duration)
+	// Put sets the value of key, creating it if it does not exist. opts can be nil.
+	Put(ctx context.Context, key string, value []byte, opts *WriteOptions) error
+	// Delete removes key. Deleting a key that does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// DeleteTree removes all the keys under directory
+	DeleteTree(ctx context.Context, directory string) error
+	// AtomicPut sets the value of key only if it has not changed since previous was read, comparing
+	// their LastIndex. A nil previous creates the key only if it does not exist.
+	// It returns the stored keypair or ErrKeyModified or ErrKeyExists if the key changed.
+	AtomicPut(ctx context.Context, key string, value []byte, previous *KVPair, opts *WriteOptions) (bool, *KVPair, error)
+	// AtomicDelete removes key only if it has not changed since previous was read, comparing
+	// their LastIndex. It returns ErrKeyModified if the key changed.
+	AtomicDelete(ctx context.Context, key string, previous *KVPair) (bool, error)
+}
+
+// Txn is implemented by the Backends that can write several keys in a single transaction
+type Txn interface {
+	// PutMany sets the values of all the keys of pairs atomically: either all of them are written
+	// or none is, and the watches see them change at once. It returns ErrTxnTooLarge, before
+	// sending anything, if pairs do not fit in a transaction.
+	PutMany(ctx context.Context, pairs map[string][]byte) error
+}
+
+// WriteOptions contains the optional arguments of Put and AtomicPut
+type WriteOptions struct {
+	// TTL makes the key expire after the duration. Backends that cannot expire keys return
+	// ErrNotSupported when it is set.
+	TTL time.Duration
 }
 
+// DefaultRequestTimeout is the deadline of the requests to a Backend when
+// Config.RequestTimeout is not set
+const DefaultRequestTimeout = 10 * time.Second
+
 // Config contains the options for a storage client
 type Config struct {
 	ClientTLS         *ClientTLSConfig
 	TLS               *tls.Config
 	ConnectionTimeout time.Duration
-	Bucket            string
+	// RequestTimeout is the deadline given to the requests whose context has none. Defaults to
+	// DefaultRequestTimeout, a negative value disables it. Watches are not affected.
+	RequestTimeout time.Duration
+	Bucket         string
+	// PersistConnection keeps the connections open between requests. Only used by Consul.
 	PersistConnection bool
 	Prefix            string
+	// Consistency is the consistency mode of the reads. Only used by Consul.
+	Consistency Consistency
+	// MaxStale is the maximum staleness of the stale reads. Older answers are read again in the
+	// default mode. Only used by Consul.
+	MaxStale time.Duration
+	// Datacenters are read in order when the local one can not serve a key. Only used by Consul.
+	Datacenters []string
+}
+
+// Consistency is the consistency mode of the reads of a Backend
+type Consistency string
+
+const (
+	// ConsistencyDefault reads from the leader, that can be stale for a short time after a new
+	// leader is elected
+	ConsistencyDefault Consistency = "default"
+	// ConsistencyStale reads from any server, which scales the reads but can be stale
+	ConsistencyStale Consistency = "stale"
+	// ConsistencyConsistent reads from a leader that checks it is still the leader before answering
+	ConsistencyConsistent Consistency = "consistent"
+)
+
+// Timeout returns the RequestTimeout of c, or DefaultRequestTimeout if it is not set. c can be
+// nil.
+func (c *Config) Timeout() time.Duration {
+	if c == nil || c.RequestTimeout == 0 {
+		return DefaultRequestTimeout
+	}
+	return c.RequestTimeout
+}
+
+// WithTimeout returns a copy of ctx with a deadline of d unless ctx already has a deadline or d
+// is not positive. The CancelFunc must be called as with context.WithTimeout.
+func WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
 }
 
 // ClientTLSConfig contains data for a Client TLS configuration in the form
-// the etcd client wants it.  Eventually we'll adapt it for ZK and Consul.
+// the etcd client wants it.  Consul loads the files again when they change.
 type ClientTLSConfig struct {
 	CertFile   string
 	KeyFile    string
@@ -59,3 +149,28 @@ type KVPair struct {
 	Value     []byte
 	LastIndex uint64
 }
+
+// TLSConfig builds a *tls.Config loading the client certificate and key and the CA
+// certificate from the files in c. Any of them can be empty.
+func (c *ClientTLSConfig) TLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.CACertFile != "" {
+		pem, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("cannot parse CA certificate " + c.CACertFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
@@ -0,0 +1,234 @@
+// Package backendtest checks the behavior shared by every backend.Backend, so the tests of a
+// Backend only need to cover what is specific to it.
+package backendtest
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Store is a Backend under test
+type Store struct {
+	backend.Backend
+	// Root is the directory holding the keys of the checks. Defaults to "app"
+	Root string
+	// Set writes kvs, keyed by their full name, from outside the Backend. The read only
+	// Backends need it and are expected to return backend.ErrNotSupported on every write. When
+	// nil, the keys are written with Put.
+	Set func(kvs map[string]string)
+	// NoVersions is set for the Backends that keep no versions to compare, whose atomic
+	// operations can only create keys
+	NoVersions bool
+}
+
+// changeTimeout is how long a watch can take to send a change
+const changeTimeout = 5 * time.Second
+
+// Run runs the checks as subtests of t. Every one of them gets a new Store from newStore, that
+// must have no keys under its Root. The polling Backends should poll often enough to notice a
+// change in less than a few seconds.
+func Run(t *testing.T, newStore func(t *testing.T) *Store) {
+	for _, c := range []struct {
+		name  string
+		check func(t *testing.T, s *Store)
+	}{
+		{"GetListExists", testGetListExists},
+		{"Writes", testWrites},
+		{"Atomic", testAtomic},
+		{"Watch", testWatch},
+		{"WatchTree", testWatchTree},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := newStore(t)
+			if s.Root == "" {
+				s.Root = "app"
+			}
+			c.check(t, s)
+		})
+	}
+}
+
+// key returns the full name of the key k under the Root of s
+func (s *Store) key(k string) string { return s.Root + "/" + k }
+
+// write sets the keys of kvs, relative to the Root of s, with Set or Put
+func (s *Store) write(t *testing.T, kvs map[string]string) {
+	if s.Set != nil {
+		full := make(map[string]string, len(kvs))
+		for k, v := range kvs {
+			full[s.key(k)] = v
+		}
+		s.Set(full)
+		return
+	}
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		require.NoError(t, s.Put(context.Background(), s.key(k), []byte(kvs[k]), nil))
+	}
+}
+
+func testGetListExists(t *testing.T, s *Store) {
+	ctx := context.Background()
+
+	_, err := s.Get(ctx, s.key("port"))
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+
+	s.write(t, map[string]string{"port": "8000", "store/host": "db.local"})
+	v, err := s.Get(ctx, "/"+s.key("port"))
+	assert.NoError(t, err)
+	assert.Equal(t, "8000", string(v))
+	// a directory is not a key
+	_, err = s.Get(ctx, s.key("store"))
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+
+	ok, err := s.Exists(ctx, s.key("port"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = s.Exists(ctx, s.key("nope"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	pairs, err := s.List(ctx, "/"+s.Root)
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	assert.Equal(t, s.key("port"), pairs[0].Key)
+	assert.Equal(t, s.key("store/host"), pairs[1].Key)
+	assert.Equal(t, "db.local", string(pairs[1].Value))
+	if !s.NoVersions {
+		assert.NotZero(t, pairs[0].LastIndex)
+	}
+
+	_, err = s.List(ctx, s.key("none"))
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+}
+
+func testWrites(t *testing.T, s *Store) {
+	ctx := context.Background()
+	if s.Set != nil {
+		assert.Equal(t, backend.ErrNotSupported, s.Put(ctx, s.key("port"), []byte("80"), nil))
+		assert.Equal(t, backend.ErrNotSupported, s.Delete(ctx, s.key("port")))
+		assert.Equal(t, backend.ErrNotSupported, s.DeleteTree(ctx, s.Root))
+		return
+	}
+
+	s.write(t, map[string]string{"v1/port": "80", "v1/store/host": "localhost", "v10/port": "81"})
+	require.NoError(t, s.Delete(ctx, s.key("v1/port")))
+	// deleting a key that does not exist is not an error
+	require.NoError(t, s.Delete(ctx, s.key("v1/port")))
+	_, err := s.Get(ctx, s.key("v1/port"))
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+
+	require.NoError(t, s.DeleteTree(ctx, s.key("v1")))
+	_, err = s.List(ctx, s.key("v1/"))
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+	// the tree is a directory, not a prefix of the names
+	v, err := s.Get(ctx, s.key("v10/port"))
+	assert.NoError(t, err)
+	assert.Equal(t, "81", string(v))
+}
+
+func testAtomic(t *testing.T, s *Store) {
+	ctx := context.Background()
+	if s.Set != nil {
+		_, _, err := s.AtomicPut(ctx, s.key("port"), []byte("80"), nil, nil)
+		assert.Equal(t, backend.ErrNotSupported, err)
+		_, err = s.AtomicDelete(ctx, s.key("port"), &backend.KVPair{Key: s.key("port")})
+		assert.Equal(t, backend.ErrNotSupported, err)
+		return
+	}
+
+	ok, pair, err := s.AtomicPut(ctx, "/"+s.key("port"), []byte("80"), nil, nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, s.key("port"), pair.Key)
+	_, _, err = s.AtomicPut(ctx, s.key("port"), []byte("81"), nil, nil)
+	assert.Equal(t, backend.ErrKeyExists, err)
+
+	if s.NoVersions {
+		_, _, err = s.AtomicPut(ctx, s.key("port"), []byte("8080"), pair, nil)
+		assert.Equal(t, backend.ErrNotSupported, err)
+		_, err = s.AtomicDelete(ctx, s.key("port"), pair)
+		assert.Equal(t, backend.ErrNotSupported, err)
+		return
+	}
+
+	ok, next, err := s.AtomicPut(ctx, s.key("port"), []byte("8080"), pair, nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.NotEqual(t, pair.LastIndex, next.LastIndex)
+	// pair is stale now
+	_, _, err = s.AtomicPut(ctx, s.key("port"), []byte("9090"), pair, nil)
+	assert.Equal(t, backend.ErrKeyModified, err)
+	_, err = s.AtomicDelete(ctx, s.key("port"), pair)
+	assert.Equal(t, backend.ErrKeyModified, err)
+	_, err = s.AtomicDelete(ctx, s.key("port"), nil)
+	assert.Equal(t, backend.ErrPreviousNotSpecified, err)
+
+	ok, err = s.AtomicDelete(ctx, s.key("port"), next)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	_, err = s.AtomicDelete(ctx, s.key("port"), next)
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+}
+
+func testWatch(t *testing.T, s *Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := s.Watch(ctx, s.key("debug"))
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+
+	s.write(t, map[string]string{"debug": "false"})
+	ch, err := s.Watch(ctx, s.key("debug"))
+	require.NoError(t, err)
+	assert.Equal(t, "false", string(<-ch))
+
+	s.write(t, map[string]string{"debug": "true"})
+	select {
+	case v := <-ch:
+		assert.Equal(t, "true", string(v))
+	case <-time.After(changeTimeout):
+		t.Fatal("no change received")
+	}
+
+	// the channel is closed once the context is done
+	cancel()
+	for range ch {
+	}
+}
+
+func testWatchTree(t *testing.T, s *Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.write(t, map[string]string{"v1/port": "80"})
+	ch, err := s.WatchTree(ctx, s.key("v1"))
+	require.NoError(t, err)
+	pairs := <-ch
+	require.Len(t, pairs, 1)
+	assert.Equal(t, s.key("v1/port"), pairs[0].Key)
+
+	s.write(t, map[string]string{"v1/host": "localhost"})
+	select {
+	case pairs = <-ch:
+		require.Len(t, pairs, 2)
+		assert.Equal(t, s.key("v1/host"), pairs[0].Key)
+		assert.Equal(t, "localhost", string(pairs[0].Value))
+	case <-time.After(changeTimeout):
+		t.Fatal("no change received")
+	}
+
+	cancel()
+	for range ch {
+	}
+}
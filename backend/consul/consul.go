@@ -1,71 +1,295 @@
 package consul
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-cleanhttp"
 	"github.com/jllopis/getconf/backend"
 )
 
 var (
 	// ErrMultipleEndpointsUnsupported is thrown when there are
 	// multiple endpoints specified for Consul
+	//
+	// Deprecated: several endpoints are supported and New does not return it anymore
 	ErrMultipleEndpointsUnsupported = errors.New("consul does not support multiple endpoints")
+	// ErrUnknownConsistency is returned by New when backend.Config.Consistency is not a known mode
+	ErrUnknownConsistency = errors.New("consul: unknown consistency mode")
 
 	watchTimeDuration = 15 * time.Second
 )
 
-// ConsulBackend holds the configuration to connect to a Consul backend
+// MaxTxnOps is the number of operations Consul accepts in a transaction
+const MaxTxnOps = 64
+
+func init() {
+	backend.Register("consul", func(endpoints []string, cnf *backend.Config) (backend.Backend, error) {
+		return New(endpoints, cnf)
+	})
+}
+
+// ConsulBackend holds the configuration to connect to a Consul backend.
+// When several agents are given, the requests are sent to one of them and move to the next healthy
+// agent when it can not be reached.
 type ConsulBackend struct {
 	sync.Mutex
-	config *api.Config
-	client *api.Client
-	prefix string
-	bucket string
+	config    *api.Config // template of the configuration of every client
+	endpoints []string
+	clients   []*api.Client // one client per endpoint
+	active    int           // index of the client in use
+	prefix    string
+	bucket    string
+	timeout   time.Duration // deadline of the requests whose context has none
+	// consistency of the reads, with the maximum staleness of the stale ones
+	consistency backend.Consistency
+	maxStale    time.Duration
+	datacenters []string // read in order, "" being the one of the configuration
+}
+
+// Options are the settings of the Consul backend that are not part of backend.Config. The empty
+// ones keep the values that api.DefaultConfig reads from the environment: CONSUL_HTTP_TOKEN,
+// CONSUL_HTTP_TOKEN_FILE, CONSUL_NAMESPACE and CONSUL_PARTITION.
+type Options struct {
+	// Token is the ACL token of the requests
+	Token string
+	// TokenFile is a file holding the ACL token. It takes precedence over Token.
+	TokenFile string
+	// Datacenter is the datacenter queried instead of the one of the agent
+	Datacenter string
+	// Namespace and Partition hold the keys. They are only available in Consul Enterprise.
+	Namespace string
+	Partition string
 }
 
 // New create a Consul backend connection with the provided options. It returns the
-// created Backend or an error
+// created Backend or an error.
+//
+// Every endpoint is the address of a Consul agent of the same cluster, that can be a unix socket.
+// When empty, the address of api.DefaultConfig is used. The Options can be set as query params
+// (token_file, datacenter, namespace and partition) of any endpoint:
+//
+//	https://consul.local:8501?datacenter=dc2&token_file=/run/secrets/consul-token
+//	unix:///var/run/consul/consul.sock
 func New(endpoints []string, cnf *backend.Config) (*ConsulBackend, error) {
-	if len(endpoints) > 1 {
-		return nil, ErrMultipleEndpointsUnsupported
+	var opts Options
+	addresses := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		address, query, _ := strings.Cut(endpoint, "?")
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		opts.TokenFile = firstNonEmpty(opts.TokenFile, q.Get("token_file"))
+		opts.Datacenter = firstNonEmpty(opts.Datacenter, q.Get("datacenter"))
+		opts.Namespace = firstNonEmpty(opts.Namespace, q.Get("namespace"))
+		opts.Partition = firstNonEmpty(opts.Partition, q.Get("partition"))
+		addresses = append(addresses, address)
 	}
+	return NewWithOptions(addresses, opts, cnf)
+}
 
-	s := &ConsulBackend{}
-	s.prefix = cnf.Prefix
-	s.bucket = cnf.Bucket
+// NewWithOptions create a Consul backend connection to the agents at endpoints.
+//
+// The reads use the consistency mode of cnf.Consistency. When the datacenter of the agent, or
+// opts.Datacenter, can not serve a key, it is read from the first of cnf.Datacenters that can.
+// The client certificate and the CA of cnf.ClientTLS are loaded again when their files change.
+// With cnf.PersistConnection the connections to the agents are kept open between requests.
+func NewWithOptions(endpoints []string, opts Options, cnf *backend.Config) (*ConsulBackend, error) {
+	s := &ConsulBackend{datacenters: []string{""}}
+	if cnf != nil {
+		s.prefix = cnf.Prefix
+		s.bucket = cnf.Bucket
+		switch cnf.Consistency {
+		case "", backend.ConsistencyDefault, backend.ConsistencyStale, backend.ConsistencyConsistent:
+		default:
+			return nil, ErrUnknownConsistency
+		}
+		s.consistency = cnf.Consistency
+		s.maxStale = cnf.MaxStale
+		s.datacenters = append(s.datacenters, cnf.Datacenters...)
+	}
+	s.timeout = cnf.Timeout()
 
 	// Create Consul client
 	config := api.DefaultConfig()
 	s.config = config
-	config.HttpClient = http.DefaultClient
-	config.Address = endpoints[0]
+	config.Transport = cleanhttp.DefaultTransport()
+	if cnf != nil && cnf.PersistConnection {
+		config.Transport = cleanhttp.DefaultPooledTransport()
+	}
+	config.HttpClient = &http.Client{Transport: config.Transport}
+	if len(endpoints) == 0 {
+		endpoints = []string{config.Address}
+	}
+	s.endpoints = endpoints
+	if opts.Token != "" {
+		config.Token = opts.Token
+	}
+	if opts.TokenFile != "" {
+		config.TokenFile = opts.TokenFile
+	}
+	if opts.Datacenter != "" {
+		config.Datacenter = opts.Datacenter
+	}
+	if opts.Namespace != "" {
+		config.Namespace = opts.Namespace
+	}
+	if opts.Partition != "" {
+		config.Partition = opts.Partition
+	}
 
 	// Set options
 	if cnf != nil {
 		if cnf.TLS != nil {
 			s.setTLS(cnf.TLS)
+		} else if cnf.ClientTLS != nil {
+			certs, err := newCertReloader(cnf.ClientTLS)
+			if err != nil {
+				return nil, err
+			}
+			s.setTLS(certs.tlsConfig())
 		}
 		if cnf.ConnectionTimeout != 0 {
 			s.setTimeout(cnf.ConnectionTimeout)
 		}
 	}
 
-	// Creates a new client
-	client, err := api.NewClient(config)
+	// Creates a client for every agent
+	for _, endpoint := range endpoints {
+		c := *config
+		c.Address = endpoint
+		if path, ok := strings.CutPrefix(endpoint, "unix://"); ok {
+			// api.NewClient would dial the socket with a transport of its own
+			c.Address = path
+			c.Transport = config.Transport.Clone()
+			c.Transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			}
+			c.HttpClient = &http.Client{Transport: c.Transport}
+		}
+		client, err := api.NewClient(&c)
+		if err != nil {
+			return nil, err
+		}
+		s.clients = append(s.clients, client)
+	}
+
+	return s, nil
+}
+
+func firstNonEmpty(v ...string) string {
+	for _, s := range v {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// certReloader holds the client certificate and the CA loaded from the files of a
+// backend.ClientTLSConfig, and loads them again when the files are modified
+type certReloader struct {
+	sync.Mutex
+	files   *backend.ClientTLSConfig
+	modTime time.Time // latest modification of the files loaded
+	loaded  *tls.Config
+}
+
+func newCertReloader(files *backend.ClientTLSConfig) (*certReloader, error) {
+	r := &certReloader{files: files}
+	modTime, err := r.lastModified()
 	if err != nil {
 		return nil, err
 	}
-	s.client = client
+	if r.loaded, err = files.TLSConfig(); err != nil {
+		return nil, err
+	}
+	r.modTime = modTime
+	return r, nil
+}
 
-	return s, nil
+// lastModified returns the latest modification time of the files
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.files.CertFile, r.files.KeyFile, r.files.CACertFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// current returns the certificates loaded, reading the files again if they have changed. While
+// they are being rotated and can not be loaded, the previous certificates are returned.
+func (r *certReloader) current() *tls.Config {
+	r.Lock()
+	defer r.Unlock()
+	modTime, err := r.lastModified()
+	if err != nil || modTime.Equal(r.modTime) {
+		return r.loaded
+	}
+	if loaded, err := r.files.TLSConfig(); err == nil {
+		r.loaded, r.modTime = loaded, modTime
+	}
+	return r.loaded
+}
+
+// tlsConfig returns a configuration that takes the certificates of every connection from r
+func (r *certReloader) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certs := r.current().Certificates
+			if len(certs) == 0 {
+				return &tls.Certificate{}, nil
+			}
+			return &certs[0], nil
+		},
+	}
+	if r.files.CACertFile != "" {
+		// the CA can change, so the chain is verified by r instead of against fixed RootCAs
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = r.verify
+	}
+	return cfg
+}
+
+// verify checks the certificate of the agent against the current CA
+func (r *certReloader) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("consul: the agent sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         r.current().RootCAs,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
 }
 
 // SetPrefix sets the prefix that will be used when building the key to query the backend.
@@ -84,9 +308,7 @@ func (s *ConsulBackend) GetBucket() string { return s.bucket }
 
 // SetTLS sets Consul TLS options
 func (s *ConsulBackend) setTLS(tls *tls.Config) {
-	s.config.HttpClient.Transport = &http.Transport{
-		TLSClientConfig: tls,
-	}
+	s.config.Transport.TLSClientConfig = tls
 	s.config.Scheme = "https"
 }
 
@@ -100,9 +322,149 @@ func (s *ConsulBackend) SetWatchTimeDuration(time time.Duration) {
 	watchTimeDuration = time
 }
 
+// queryOptions returns the options of a request bound to ctx, that gets the default deadline of
+// the backend if it has none. cancel must be called once the request is done.
+func (s *ConsulBackend) queryOptions(ctx context.Context) (*api.QueryOptions, context.CancelFunc) {
+	ctx, cancel := backend.WithTimeout(ctx, s.timeout)
+	return (&api.QueryOptions{}).WithContext(ctx), cancel
+}
+
+// writeOptions is as queryOptions for the write requests
+func (s *ConsulBackend) writeOptions(ctx context.Context) (*api.WriteOptions, context.CancelFunc) {
+	ctx, cancel := backend.WithTimeout(ctx, s.timeout)
+	return (&api.WriteOptions{}).WithContext(ctx), cancel
+}
+
+// Endpoint returns the address of the agent the requests are sent to
+func (s *ConsulBackend) Endpoint() string {
+	i, _ := s.client()
+	return s.endpoints[i]
+}
+
+// client returns the client in use and its index
+func (s *ConsulBackend) client() (int, *api.Client) {
+	s.Lock()
+	defer s.Unlock()
+	return s.active, s.clients[s.active]
+}
+
+// do runs fn with the client in use. If its agent can not be reached, the backend fails over to
+// the next healthy agent and fn is run again with it, until every agent has been tried.
+// ctx must be the context of the requests made by fn; once it is done there is no failover.
+func (s *ConsulBackend) do(ctx context.Context, fn func(*api.Client) error) error {
+	i, c := s.client()
+	err := fn(c)
+	for tried := 1; tried < len(s.clients) && isConnError(ctx, err); tried++ {
+		var ok bool
+		if i, c, ok = s.failover(ctx, i); !ok {
+			break
+		}
+		err = fn(c)
+	}
+	return err
+}
+
+// failover moves the backend from the client at index failed, whose agent could not be reached,
+// to the next healthy agent and returns its client. If another request failed over already, the
+// client in use is returned. It returns false if no other agent is healthy.
+// The agents are checked without holding the lock, so the other requests are not blocked.
+func (s *ConsulBackend) failover(ctx context.Context, failed int) (int, *api.Client, bool) {
+	if i, c := s.client(); i != failed {
+		return i, c, true
+	}
+	for n := 1; n < len(s.clients); n++ {
+		i := (failed + n) % len(s.clients)
+		if !s.healthy(ctx, s.clients[i]) {
+			continue
+		}
+		s.Lock()
+		defer s.Unlock()
+		if s.active == failed {
+			s.active = i
+		}
+		return s.active, s.clients[s.active], true
+	}
+	return failed, nil, false
+}
+
+// healthy checks that the agent of c answers and the cluster has a leader
+func (s *ConsulBackend) healthy(ctx context.Context, c *api.Client) bool {
+	ctx, cancel := backend.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	var leader string
+	_, err := c.Raw().Query("/v1/status/leader", &leader, (&api.QueryOptions{}).WithContext(ctx))
+	return err == nil && leader != ""
+}
+
+// isConnError reports whether err means that the agent could not be reached. The errors of a
+// request whose context ctx is done are not.
+func isConnError(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var uerr *url.Error
+	var nerr net.Error
+	return errors.As(err, &uerr) || errors.As(err, &nerr)
+}
+
+// nextIndex returns the WaitIndex of the blocking query that follows one answered with index.
+// After a failover the index of the new agent can be behind, and the query starts over from 0.
+func nextIndex(prev, index uint64) uint64 {
+	if index < prev {
+		return 0
+	}
+	return index
+}
+
+// readFunc runs a read with client c and the options q, returning backend.ErrKeyNotFound when
+// there are no keys
+type readFunc func(c *api.Client, q *api.QueryOptions) (*api.QueryMeta, error)
+
+// query runs fn in the datacenter dc with the consistency mode of the backend. A stale read
+// answered by a server that has not heard from the leader for longer than maxStale is repeated in
+// the default mode.
+func (s *ConsulBackend) query(q *api.QueryOptions, dc string, fn readFunc) (*api.QueryMeta, error) {
+	o := *q
+	o.Datacenter = dc
+	o.AllowStale = s.consistency == backend.ConsistencyStale
+	o.RequireConsistent = s.consistency == backend.ConsistencyConsistent
+	var meta *api.QueryMeta
+	read := func(c *api.Client) (err error) {
+		meta, err = fn(c, &o)
+		return err
+	}
+	err := s.do(o.Context(), read)
+	if o.AllowStale && s.maxStale > 0 && meta != nil && meta.LastContact > s.maxStale {
+		o.AllowStale = false
+		err = s.do(o.Context(), read)
+	}
+	return meta, err
+}
+
+// read runs fn in the datacenters of the backend in order until one of them can serve it, and
+// returns the datacenter of the answer
+func (s *ConsulBackend) read(q *api.QueryOptions, fn readFunc) (string, *api.QueryMeta, error) {
+	var dc string
+	var meta *api.QueryMeta
+	var err error
+	for _, dc = range s.datacenters {
+		if meta, err = s.query(q, dc, fn); !fallback(q.Context(), err) {
+			break
+		}
+	}
+	return dc, meta, err
+}
+
+// fallback reports whether a read that failed with err can be served by another datacenter. When
+// the agent can not be reached, the other datacenters can not either.
+func fallback(ctx context.Context, err error) bool {
+	return err != nil && !isConnError(ctx, err) && ctx.Err() == nil
+}
+
 // Exists return true if key exists in backend and false otherwise
-func (s *ConsulBackend) Exists(key string) (bool, error) {
-	_, err := s.Get(context.TODO(), key)
+// It is safe to provide a timeout by using context.Timeout.
+func (s *ConsulBackend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Get(ctx, key)
 	if err != nil {
 		if err == backend.ErrKeyNotFound {
 			return false, nil
@@ -116,27 +478,208 @@ func (s *ConsulBackend) Exists(key string) (bool, error) {
 // It is safe to provide a timeout by using context.Timeout.
 func (s *ConsulBackend) Get(ctx context.Context, key string) ([]byte, error) {
 	key = strings.TrimPrefix(key, "/")
-	kv, _, err := s.client.KV().Get(key, nil)
+	opts, cancel := s.queryOptions(ctx)
+	defer cancel()
+	var kv *api.KVPair
+	_, _, err := s.read(opts, func(c *api.Client, q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		if kv, meta, err = c.KV().Get(key, q); err == nil && kv == nil {
+			err = backend.ErrKeyNotFound
+		}
+		return meta, err
+	})
 	if err != nil {
 		return nil, err
 	}
-	if kv == nil {
-		return nil, backend.ErrKeyNotFound
-	}
 	return kv.Value, nil
 }
 
+// Put sets the value of key, creating it if it does not exist.
+// A TTL is implemented by acquiring the key with a session that deletes it when it expires.
+func (s *ConsulBackend) Put(ctx context.Context, key string, value []byte, opts *backend.WriteOptions) error {
+	p := &api.KVPair{Key: strings.TrimPrefix(key, "/"), Value: value}
+	wo, cancel := s.writeOptions(ctx)
+	defer cancel()
+	if opts == nil || opts.TTL == 0 {
+		return s.do(wo.Context(), func(c *api.Client) error {
+			_, err := c.KV().Put(p, wo)
+			return err
+		})
+	}
+	session, err := s.ttlSession(ctx, opts.TTL)
+	if err != nil {
+		return err
+	}
+	p.Session = session
+	var ok bool
+	err = s.do(wo.Context(), func(c *api.Client) (err error) {
+		ok, _, err = c.KV().Acquire(p, wo)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("consul: cannot acquire %s, it is locked by another session", p.Key)
+	}
+	return nil
+}
+
+// ttlSession creates a session that deletes the keys it holds when it expires after ttl
+func (s *ConsulBackend) ttlSession(ctx context.Context, ttl time.Duration) (string, error) {
+	wo, cancel := s.writeOptions(ctx)
+	defer cancel()
+	var id string
+	err := s.do(wo.Context(), func(c *api.Client) (err error) {
+		id, _, err = c.Session().Create(&api.SessionEntry{
+			TTL:       ttl.String(),
+			Behavior:  api.SessionBehaviorDelete,
+			LockDelay: time.Millisecond,
+		}, wo)
+		return err
+	})
+	return id, err
+}
+
+// Delete removes key. Deleting a key that does not exist is not an error.
+func (s *ConsulBackend) Delete(ctx context.Context, key string) error {
+	wo, cancel := s.writeOptions(ctx)
+	defer cancel()
+	return s.do(wo.Context(), func(c *api.Client) error {
+		_, err := c.KV().Delete(strings.TrimPrefix(key, "/"), wo)
+		return err
+	})
+}
+
+// DeleteTree removes all the keys under directory
+func (s *ConsulBackend) DeleteTree(ctx context.Context, directory string) error {
+	directory = strings.TrimPrefix(directory, "/")
+	if directory != "" && directory[len(directory)-1] != '/' {
+		directory += "/"
+	}
+	wo, cancel := s.writeOptions(ctx)
+	defer cancel()
+	return s.do(wo.Context(), func(c *api.Client) error {
+		_, err := c.KV().DeleteTree(directory, wo)
+		return err
+	})
+}
+
+// AtomicPut sets the value of key only if its ModifyIndex is still the LastIndex of previous.
+// A nil previous creates the key only if it does not exist.
+func (s *ConsulBackend) AtomicPut(ctx context.Context, key string, value []byte, previous *backend.KVPair, opts *backend.WriteOptions) (bool, *backend.KVPair, error) {
+	key = strings.TrimPrefix(key, "/")
+	// an index of 0 only succeeds if the key does not exist
+	var index uint64
+	if previous != nil {
+		index = previous.LastIndex
+	}
+	ops := api.TxnOps{{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: key, Value: value, Index: index}}}
+	if opts != nil && opts.TTL != 0 {
+		session, err := s.ttlSession(ctx, opts.TTL)
+		if err != nil {
+			return false, nil, err
+		}
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVLock, Key: key, Value: value, Session: session}})
+	}
+	qo, cancel := s.queryOptions(ctx)
+	defer cancel()
+	var ok bool
+	var resp *api.TxnResponse
+	err := s.do(qo.Context(), func(c *api.Client) (err error) {
+		ok, resp, _, err = c.Txn().Txn(ops, qo)
+		return err
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	if !ok {
+		if previous == nil {
+			return false, nil, backend.ErrKeyExists
+		}
+		return false, nil, backend.ErrKeyModified
+	}
+	res := resp.Results[len(resp.Results)-1].KV
+	return true, &backend.KVPair{Key: key, Value: value, LastIndex: res.ModifyIndex}, nil
+}
+
+// PutMany sets the values of all the keys of pairs in a single transaction of the /v1/txn API.
+// More than MaxTxnOps keys return backend.ErrTxnTooLarge without sending any: splitting them in
+// several transactions would not be atomic.
+func (s *ConsulBackend) PutMany(ctx context.Context, pairs map[string][]byte) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	if len(pairs) > MaxTxnOps {
+		return fmt.Errorf("consul: %d keys, at most %d: %w", len(pairs), MaxTxnOps, backend.ErrTxnTooLarge)
+	}
+	ops := make(api.TxnOps, 0, len(pairs))
+	for key, value := range pairs {
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: strings.TrimPrefix(key, "/"), Value: value}})
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].KV.Key < ops[j].KV.Key })
+	qo, cancel := s.queryOptions(ctx)
+	defer cancel()
+	var ok bool
+	var resp *api.TxnResponse
+	err := s.do(qo.Context(), func(c *api.Client) (err error) {
+		ok, resp, _, err = c.Txn().Txn(ops, qo)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		msgs := []string{}
+		for _, e := range resp.Errors {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", ops[e.OpIndex].KV.Key, e.What))
+		}
+		return fmt.Errorf("consul: transaction rolled back: %s", strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+// AtomicDelete removes key only if its ModifyIndex is still the LastIndex of previous
+func (s *ConsulBackend) AtomicDelete(ctx context.Context, key string, previous *backend.KVPair) (bool, error) {
+	if previous == nil {
+		return false, backend.ErrPreviousNotSpecified
+	}
+	key = strings.TrimPrefix(key, "/")
+	wo, cancel := s.writeOptions(ctx)
+	defer cancel()
+	var ok bool
+	err := s.do(wo.Context(), func(c *api.Client) (err error) {
+		ok, _, err = c.KV().DeleteCAS(&api.KVPair{Key: key, ModifyIndex: previous.LastIndex}, wo)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		if _, err := s.Get(ctx, key); err != nil {
+			return false, err
+		}
+		return false, backend.ErrKeyModified
+	}
+	return true, nil
+}
+
 // List will get all keypairs under a prefix
 // It is safe to provide a timeout by using context.Timeout.
+// All the keypairs are read from the same datacenter.
 func (s *ConsulBackend) List(ctx context.Context, key string) ([]*backend.KVPair, error) {
 	key = strings.TrimPrefix(key, "/")
-	pairs, _, err := s.client.KV().List(key, nil)
+	opts, cancel := s.queryOptions(ctx)
+	defer cancel()
+	var pairs api.KVPairs
+	_, _, err := s.read(opts, func(c *api.Client, q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		if pairs, meta, err = c.KV().List(key, q); err == nil && len(pairs) == 0 {
+			err = backend.ErrKeyNotFound
+		}
+		return meta, err
+	})
 	if err != nil {
 		return nil, err
 	}
-	if len(pairs) == 0 {
-		return nil, backend.ErrKeyNotFound
-	}
 	ret := []*backend.KVPair{}
 	for _, kv := range pairs {
 		// if pair.Key == directory {
@@ -151,18 +694,29 @@ func (s *ConsulBackend) List(ctx context.Context, key string) ([]*backend.KVPair
 // It returns a channel that will receive changes or pass on errors.
 // When created, the current value will be sent to the channel.
 // You can stop by using a context.Cancel when calling the method.
+// After a failover the blocking query resumes from the last index on the new agent, and a change
+// is only sent once. When the datacenter watched can not serve the key anymore, the watch moves to
+// the first datacenter that can, and every time the blocking query returns the preferred
+// datacenters are tried again.
 func (s *ConsulBackend) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	key = strings.TrimPrefix(key, "/")
 	respChan := make(chan []byte, 0)
-	keypair, meta, err := s.client.KV().Get(key, nil)
+	var keypair *api.KVPair
+	get := func(c *api.Client, q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		if keypair, meta, err = c.KV().Get(key, q); err == nil && keypair == nil {
+			err = backend.ErrKeyNotFound
+		}
+		return meta, err
+	}
+	opts, cancel := s.queryOptions(ctx)
+	dc, meta, err := s.read(opts, get)
+	cancel()
 	if err != nil {
 		return nil, err
 	}
-	if keypair == nil && err == nil {
-		return nil, backend.ErrKeyNotFound
-	}
-	go func(wi uint64) { // TODO: quit con cxt.Done()
+	go func(dc string, waitIndex uint64, sent *api.KVPair) {
 		defer close(respChan)
-		waitIndex := wi
+		sentDC := dc
 		for {
 			select {
 			case <-ctx.Done():
@@ -170,22 +724,49 @@ func (s *ConsulBackend) Watch(ctx context.Context, key string) (<-chan []byte, e
 				return
 			default:
 			}
-			opts := api.QueryOptions{
-				WaitIndex: waitIndex,
+			opts := (&api.QueryOptions{WaitIndex: waitIndex, WaitTime: watchTimeDuration}).WithContext(ctx)
+			meta, err := s.query(opts, dc, get)
+			if err == nil || err == backend.ErrKeyNotFound {
+				waitIndex = nextIndex(waitIndex, meta.LastIndex)
+			}
+			if len(s.datacenters) > 1 && fallback(ctx, err) {
+				if served, meta, ferr := s.read((&api.QueryOptions{}).WithContext(ctx), get); ferr == nil {
+					dc, waitIndex, err = served, meta.LastIndex, nil
+				}
+			} else if err == nil && dc != s.datacenters[0] {
+				// a watch moved to another datacenter goes back as soon as a preferred one can
+				// serve the key again
+				kp := keypair
+				if served, meta, ferr := s.read((&api.QueryOptions{}).WithContext(ctx), get); ferr == nil && served != dc {
+					dc, waitIndex = served, meta.LastIndex
+				} else {
+					keypair = kp
+				}
+			}
+			if err == backend.ErrKeyNotFound {
+				continue
 			}
-			keypair, meta, err := s.client.KV().Get(key, &opts)
 			if err != nil {
 				return
 			}
-			// If LastIndex didn't change then it means `Get` returned
-			// because of the WaitTime and the key didn't changed.
-			if opts.WaitIndex == meta.LastIndex {
+			// The query also returns on the WaitTime, on changes of other keys and when it starts
+			// over after a failover. Only a new ModifyIndex of the key is a change, or a new value
+			// when it is read from another datacenter.
+			same := keypair.ModifyIndex == sent.ModifyIndex
+			if dc != sentDC {
+				same = bytes.Equal(keypair.Value, sent.Value)
+			}
+			sent, sentDC = keypair, dc
+			if same {
 				continue
 			}
-			waitIndex = meta.LastIndex
-			respChan <- keypair.Value
+			select {
+			case respChan <- keypair.Value:
+			case <-ctx.Done():
+				return
+			}
 		}
-	}(meta.LastIndex)
+	}(dc, meta.LastIndex, keypair)
 	return respChan, nil
 }
 
@@ -194,16 +775,29 @@ func (s *ConsulBackend) Watch(ctx context.Context, key string) (<-chan []byte, e
 // It returns a channel that will receive changes or pass on errors.
 // When created, the current values will be sent to the channel.
 // You can stop by using a context.Cancel when calling the method.
+// After a failover the blocking query resumes from the last index on the new agent, and a change
+// is only sent once. When the datacenter watched has no keys under directory, the watch moves to
+// the first datacenter that has, and every time the blocking query returns the preferred
+// datacenters are tried again.
 func (s *ConsulBackend) WatchTree(ctx context.Context, directory string) (<-chan []*backend.KVPair, error) {
 	respCh := make(chan []*backend.KVPair)
-	if directory[len(directory)-1] != '/' {
+	directory = strings.TrimPrefix(directory, "/")
+	if directory != "" && directory[len(directory)-1] != '/' {
 		directory += "/"
 	}
 
 	go func() {
 		defer close(respCh)
+		var dc, sentDC string
 		var waitIndex uint64
-		opts := &api.QueryOptions{WaitTime: watchTimeDuration}
+		var last []*backend.KVPair
+		var pairs api.KVPairs
+		list := func(c *api.Client, q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+			if pairs, meta, err = c.KV().List(directory, q); err == nil && len(pairs) == 0 {
+				err = backend.ErrKeyNotFound
+			}
+			return meta, err
+		}
 		for {
 			// Check if we should quit
 			select {
@@ -214,21 +808,29 @@ func (s *ConsulBackend) WatchTree(ctx context.Context, directory string) (<-chan
 			}
 
 			// Get all the childrens
-			directory = strings.TrimPrefix(directory, "/")
-			pairs, meta, err := s.client.KV().List(directory, opts)
-			if err != nil {
-				return
+			opts := (&api.QueryOptions{WaitIndex: waitIndex, WaitTime: watchTimeDuration}).WithContext(ctx)
+			meta, err := s.query(opts, dc, list)
+			if err == nil || err == backend.ErrKeyNotFound {
+				waitIndex = nextIndex(waitIndex, meta.LastIndex)
 			}
-
-			// If LastIndex didn't change then it means `Get` returned
-			// because of the WaitTime and the child keys didn't change.
-			if waitIndex == meta.LastIndex {
-				time.Sleep(watchTimeDuration)
-				continue
+			if len(s.datacenters) > 1 && fallback(ctx, err) {
+				if served, meta, ferr := s.read((&api.QueryOptions{}).WithContext(ctx), list); ferr == nil {
+					dc, waitIndex, err = served, meta.LastIndex, nil
+				}
+			} else if err == nil && dc != s.datacenters[0] {
+				// a watch moved to another datacenter goes back as soon as a preferred one has
+				// keys under directory again
+				ps := pairs
+				if served, meta, ferr := s.read((&api.QueryOptions{}).WithContext(ctx), list); ferr == nil && served != dc {
+					dc, waitIndex = served, meta.LastIndex
+				} else {
+					pairs = ps
+				}
+			}
+			if err != nil && err != backend.ErrKeyNotFound {
+				return
 			}
-			waitIndex = meta.LastIndex
 
-			// Return children KV pairs to the channel
 			kvpairs := []*backend.KVPair{}
 			for _, pair := range pairs {
 				if pair.Key == directory {
@@ -240,9 +842,39 @@ func (s *ConsulBackend) WatchTree(ctx context.Context, directory string) (<-chan
 					LastIndex: pair.ModifyIndex,
 				})
 			}
-			respCh <- kvpairs
+			// The query also returns on the WaitTime, on changes of other keys and when it starts
+			// over after a failover. Only the first values and the changes of the tree are sent.
+			if last != nil && sameTree(last, kvpairs, dc != sentDC) {
+				sentDC = dc
+				continue
+			}
+			last, sentDC = kvpairs, dc
+
+			// Return children KV pairs to the channel
+			select {
+			case respCh <- kvpairs:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	return respCh, nil
 }
+
+// sameTree reports whether a and b hold the same keys with the same indexes, or with the same
+// values when byValue is set because they come from different datacenters
+func sameTree(a, b []*backend.KVPair, byValue bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key {
+			return false
+		}
+		if byValue && !bytes.Equal(a[i].Value, b[i].Value) || !byValue && a[i].LastIndex != b[i].LastIndex {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,640 @@
+package consul
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/jllopis/getconf/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCluster is the KV store of a Consul cluster shared by its fake agents
+type fakeCluster struct {
+	sync.Mutex
+	index   uint64
+	kv      map[string]*api.KVPair
+	changed chan struct{} // closed and replaced on every write
+	// remote are the other datacenters, lastContact is the staleness of the answers and reads
+	// records the consistency mode of every read
+	remote      map[string]*fakeCluster
+	lastContact time.Duration
+	reads       []string
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{index: 1, kv: map[string]*api.KVPair{}, changed: make(chan struct{})}
+}
+
+func (f *fakeCluster) put(key string, value []byte) {
+	f.Lock()
+	defer f.Unlock()
+	f.index++
+	p, ok := f.kv[key]
+	if !ok {
+		p = &api.KVPair{Key: key, CreateIndex: f.index}
+		f.kv[key] = p
+	}
+	p.Value, p.ModifyIndex = value, f.index
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// agent starts a fake agent of the cluster. leader is the answer of /v1/status/leader.
+func (f *fakeCluster) agent(t *testing.T, leader string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status/leader", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(leader)
+	})
+	mux.HandleFunc("/v1/txn", func(w http.ResponseWriter, r *http.Request) {
+		var ops api.TxnOps
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := api.TxnResponse{}
+		for i, op := range ops {
+			if op.KV.Verb != api.KVSet || op.KV.Key == "" {
+				resp.Errors = append(resp.Errors, &api.TxnError{OpIndex: i, What: "invalid operation"})
+			}
+		}
+		if len(resp.Errors) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		f.Lock()
+		f.index++
+		for _, op := range ops {
+			f.kv[op.KV.Key] = &api.KVPair{Key: op.KV.Key, Value: op.KV.Value, ModifyIndex: f.index}
+			resp.Results = append(resp.Results, &api.TxnResult{KV: f.kv[op.KV.Key]})
+		}
+		close(f.changed)
+		f.changed = make(chan struct{})
+		f.Unlock()
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/v1/kv/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		f := f
+		if dc := r.URL.Query().Get("dc"); dc != "" {
+			if f = f.remote[dc]; f == nil {
+				http.Error(w, "No path to datacenter", http.StatusInternalServerError)
+				return
+			}
+		}
+		if r.Method == http.MethodPut {
+			body, _ := ioutil.ReadAll(r.Body)
+			f.put(key, body)
+			w.Write([]byte("true"))
+			return
+		}
+		mode := "default"
+		for _, m := range []string{"stale", "consistent"} {
+			if _, ok := r.URL.Query()[m]; ok {
+				mode = m
+			}
+		}
+		f.Lock()
+		f.reads = append(f.reads, mode)
+		if mode == "stale" {
+			w.Header().Set("X-Consul-LastContact", strconv.FormatInt(f.lastContact.Milliseconds(), 10))
+		}
+		f.Unlock()
+		// blocking query
+		index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+		if err != nil {
+			wait = time.Minute
+		}
+		timeout := time.After(wait)
+		for {
+			f.Lock()
+			current, changed := f.index, f.changed
+			pairs := api.KVPairs{}
+			for k, p := range f.kv {
+				if k == key || (r.URL.Query()["recurse"] != nil && strings.HasPrefix(k, key)) {
+					c := *p
+					pairs = append(pairs, &c)
+				}
+			}
+			f.Unlock()
+			if index < current {
+				sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+				w.Header().Set("X-Consul-Index", strconv.FormatUint(current, 10))
+				if len(pairs) == 0 {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				json.NewEncoder(w).Encode(pairs)
+				return
+			}
+			select {
+			case <-changed:
+			case <-timeout:
+				index = 0
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// stop makes the agent unreachable, breaking its blocking queries
+func stop(srv *httptest.Server) {
+	srv.CloseClientConnections()
+	srv.Close()
+}
+
+func TestFailover(t *testing.T) {
+	f := newFakeCluster()
+	f.put("app/port", []byte("8080"))
+	a := f.agent(t, "10.0.0.1:8300")
+	noLeader := f.agent(t, "")
+	c := f.agent(t, "10.0.0.1:8300")
+
+	s, err := New([]string{a.URL, noLeader.URL, c.URL}, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	v, err := s.Get(ctx, "/app/port")
+	require.NoError(t, err)
+	assert.Equal(t, "8080", string(v))
+	assert.Equal(t, a.URL, s.Endpoint())
+
+	stop(a)
+	v, err = s.Get(ctx, "app/port")
+	require.NoError(t, err)
+	assert.Equal(t, "8080", string(v))
+	// the agent without leader is skipped
+	assert.Equal(t, c.URL, s.Endpoint())
+
+	require.NoError(t, s.Put(ctx, "app/host", []byte("localhost"), nil))
+	pairs, err := s.List(ctx, "app/")
+	require.NoError(t, err)
+	assert.Len(t, pairs, 2)
+
+	stop(c)
+	_, err = s.Get(ctx, "app/port")
+	assert.Error(t, err)
+}
+
+func TestNewEndpoints(t *testing.T) {
+	s, err := New(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, api.DefaultConfig().Address, s.Endpoint())
+	assert.Equal(t, backend.DefaultRequestTimeout, s.timeout)
+}
+
+func TestWatch(t *testing.T) {
+	f := newFakeCluster()
+	f.put("app/debug", []byte("false"))
+	a := f.agent(t, "10.0.0.1:8300")
+	b := f.agent(t, "10.0.0.1:8300")
+	s, err := New([]string{a.URL, b.URL}, nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = s.Watch(ctx, "app/none")
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+
+	ch, err := s.Watch(ctx, "/app/debug")
+	require.NoError(t, err)
+	f.put("app/debug", []byte("true"))
+	select {
+	case v := <-ch:
+		assert.Equal(t, "true", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+
+	// the watch resumes on b, changes of other keys are not sent
+	stop(a)
+	f.put("app/other", []byte("1"))
+	f.put("app/debug", []byte("false"))
+	select {
+	case v := <-ch:
+		assert.Equal(t, "false", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+	assert.Equal(t, b.URL, s.Endpoint())
+	select {
+	case v := <-ch:
+		t.Fatalf("duplicate change received: %s", v)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestWatchTree(t *testing.T) {
+	f := newFakeCluster()
+	a := f.agent(t, "10.0.0.1:8300")
+	b := f.agent(t, "10.0.0.1:8300")
+	s, err := New([]string{a.URL, b.URL}, nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := s.WatchTree(ctx, "app/v1")
+	require.NoError(t, err)
+	assert.Len(t, <-ch, 0)
+
+	f.put("app/v1/host", []byte("localhost"))
+	select {
+	case pairs := <-ch:
+		require.Len(t, pairs, 1)
+		assert.Equal(t, "app/v1/host", pairs[0].Key)
+		assert.Equal(t, "localhost", string(pairs[0].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+
+	stop(a)
+	f.put("app/v2/host", []byte("remote"))
+	f.put("app/v1/port", []byte("80"))
+	select {
+	case pairs := <-ch:
+		require.Len(t, pairs, 2)
+		assert.Equal(t, "app/v1/port", pairs[1].Key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+	select {
+	case pairs := <-ch:
+		t.Fatalf("duplicate change received: %v", pairs)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("X-Consul-Index", "1")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	s, err := New([]string{srv.URL + "?datacenter=dc2&namespace=team&partition=apps&token_file=" + tokenFile}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL, s.Endpoint())
+	_, err = s.Get(context.Background(), "app/port")
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+	assert.Equal(t, "secret", got.Header.Get("X-Consul-Token"))
+	assert.Equal(t, "dc2", got.URL.Query().Get("dc"))
+	assert.Equal(t, "team", got.URL.Query().Get("ns"))
+	assert.Equal(t, "apps", got.URL.Query().Get("partition"))
+
+	t.Setenv("CONSUL_HTTP_TOKEN", "from-env")
+	s, err = New([]string{srv.URL}, nil)
+	require.NoError(t, err)
+	s.Get(context.Background(), "app/port")
+	assert.Equal(t, "from-env", got.Header.Get("X-Consul-Token"))
+	s, err = NewWithOptions([]string{srv.URL}, Options{Token: "given"}, nil)
+	require.NoError(t, err)
+	s.Get(context.Background(), "app/port")
+	assert.Equal(t, "given", got.Header.Get("X-Consul-Token"))
+}
+
+func TestUnixSocket(t *testing.T) {
+	f := newFakeCluster()
+	f.put("app/port", []byte("8080"))
+	sock := filepath.Join(t.TempDir(), "consul.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	srv := f.agent(t, "10.0.0.1:8300")
+	srv.Listener.Close()
+	unix := httptest.NewUnstartedServer(srv.Config.Handler)
+	unix.Listener = l
+	unix.Start()
+	defer unix.Close()
+
+	s, err := New([]string{"unix://" + sock}, &backend.Config{PersistConnection: true})
+	require.NoError(t, err)
+	v, err := s.Get(context.Background(), "app/port")
+	require.NoError(t, err)
+	assert.Equal(t, "8080", string(v))
+}
+
+// newCert creates a certificate for name signed by ca, or self signed if ca is nil, and writes it
+// and its key to dir/name.pem and dir/name-key.pem
+func newCert(t *testing.T, dir, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert
+}
+
+// rotate replaces the file at dst with src, making sure its modification time changes
+func rotate(t *testing.T, src, dst string) {
+	require.NoError(t, os.Rename(src, dst))
+	next := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(dst, next, next))
+}
+
+func TestClientTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, dir, "ca", nil)
+	newCert(t, dir, "client", &ca)
+	serverCert := newCert(t, dir, "server", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	var client string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = r.TLS.PeerCertificates[0].Subject.CommonName
+		json.NewEncoder(w).Encode(api.KVPairs{{Key: "app/port", Value: []byte("8080")}})
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	s, err := New([]string{srv.URL}, &backend.Config{ClientTLS: &backend.ClientTLSConfig{
+		CertFile:   filepath.Join(dir, "client.pem"),
+		KeyFile:    filepath.Join(dir, "client-key.pem"),
+		CACertFile: filepath.Join(dir, "ca.pem"),
+	}})
+	require.NoError(t, err)
+	ctx := context.Background()
+	_, err = s.Get(ctx, "app/port")
+	require.NoError(t, err)
+	assert.Equal(t, "client", client)
+
+	// the client certificate is rotated
+	newCert(t, dir, "client2", &ca)
+	rotate(t, filepath.Join(dir, "client2-key.pem"), filepath.Join(dir, "client-key.pem"))
+	rotate(t, filepath.Join(dir, "client2.pem"), filepath.Join(dir, "client.pem"))
+	_, err = s.Get(ctx, "app/port")
+	require.NoError(t, err)
+	assert.Equal(t, "client2", client)
+
+	// a CA that did not sign the certificate of the agent is rejected
+	newCert(t, dir, "ca2", nil)
+	rotate(t, filepath.Join(dir, "ca2.pem"), filepath.Join(dir, "ca.pem"))
+	_, err = s.Get(ctx, "app/port")
+	assert.Error(t, err)
+
+	_, err = New([]string{srv.URL}, &backend.Config{ClientTLS: &backend.ClientTLSConfig{CACertFile: filepath.Join(dir, "none.pem")}})
+	assert.Error(t, err)
+}
+
+func TestConsistency(t *testing.T) {
+	f := newFakeCluster()
+	f.put("app/port", []byte("8080"))
+	a := f.agent(t, "10.0.0.1:8300")
+	ctx := context.Background()
+
+	s, err := New([]string{a.URL}, &backend.Config{Consistency: backend.ConsistencyStale, MaxStale: time.Second})
+	require.NoError(t, err)
+	_, err = s.Get(ctx, "app/port")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"stale"}, f.reads)
+	// too stale, read again from the leader
+	f.lastContact = 5 * time.Second
+	_, err = s.List(ctx, "app/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"stale", "stale", "default"}, f.reads)
+
+	s, err = New([]string{a.URL}, &backend.Config{Consistency: backend.ConsistencyConsistent})
+	require.NoError(t, err)
+	_, err = s.Get(ctx, "app/port")
+	require.NoError(t, err)
+	assert.Equal(t, "consistent", f.reads[len(f.reads)-1])
+
+	_, err = New([]string{a.URL}, &backend.Config{Consistency: "eventual"})
+	assert.Equal(t, ErrUnknownConsistency, err)
+}
+
+func TestDatacenterFallback(t *testing.T) {
+	f, dc2, dc3 := newFakeCluster(), newFakeCluster(), newFakeCluster()
+	f.remote = map[string]*fakeCluster{"dc2": dc2, "dc3": dc3}
+	dc2.put("app/port", []byte("8080"))
+	dc3.put("app/port", []byte("9090"))
+	dc3.put("app/host", []byte("remote"))
+	a := f.agent(t, "10.0.0.1:8300")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := New([]string{a.URL}, &backend.Config{Datacenters: []string{"none", "dc2", "dc3"}})
+	require.NoError(t, err)
+	v, err := s.Get(ctx, "app/port")
+	require.NoError(t, err)
+	assert.Equal(t, "8080", string(v))
+	v, err = s.Get(ctx, "app/host")
+	require.NoError(t, err)
+	assert.Equal(t, "remote", string(v))
+	_, err = s.Get(ctx, "app/none")
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+	pairs, err := s.List(ctx, "app/")
+	require.NoError(t, err)
+	assert.Len(t, pairs, 1)
+
+	// the watch follows the key to dc3 once dc2 loses it
+	ch, err := s.Watch(ctx, "app/port")
+	require.NoError(t, err)
+	dc2.put("app/port", []byte("8081"))
+	select {
+	case v := <-ch:
+		assert.Equal(t, "8081", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+	dc2.Lock()
+	delete(dc2.kv, "app/port")
+	dc2.Unlock()
+	dc2.put("app/other", nil)
+	select {
+	case v := <-ch:
+		assert.Equal(t, "9090", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestDatacenterRecovery(t *testing.T) {
+	f, dc2 := newFakeCluster(), newFakeCluster()
+	f.remote = map[string]*fakeCluster{"dc2": dc2}
+	dc2.put("app/port", []byte("8080"))
+	a := f.agent(t, "10.0.0.1:8300")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := New([]string{a.URL}, &backend.Config{Datacenters: []string{"dc2"}})
+	require.NoError(t, err)
+	ch, err := s.Watch(ctx, "app/port")
+	require.NoError(t, err)
+	tree, err := s.WatchTree(ctx, "app")
+	require.NoError(t, err)
+	assert.Equal(t, "8080", string((<-tree)[0].Value))
+
+	// the local datacenter gets the key back, seen when the query on dc2 returns
+	f.put("app/port", []byte("9090"))
+	dc2.put("app/other", nil)
+	select {
+	case v := <-ch:
+		assert.Equal(t, "9090", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+	select {
+	case pairs := <-tree:
+		require.Len(t, pairs, 1)
+		assert.Equal(t, "9090", string(pairs[0].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+
+	// the watches follow the local datacenter again
+	f.put("app/port", []byte("9091"))
+	select {
+	case v := <-ch:
+		assert.Equal(t, "9091", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+	select {
+	case pairs := <-tree:
+		require.Len(t, pairs, 1)
+		assert.Equal(t, "9091", string(pairs[0].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestPutMany(t *testing.T) {
+	f := newFakeCluster()
+	a := f.agent(t, "10.0.0.1:8300")
+	s, err := New([]string{a.URL}, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, s.PutMany(ctx, map[string][]byte{"/app/host": []byte("db.remote"), "app/port": []byte("6543")}))
+	pairs, err := s.List(ctx, "app/")
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	assert.Equal(t, "db.remote", string(pairs[0].Value))
+	assert.Equal(t, pairs[0].LastIndex, pairs[1].LastIndex)
+
+	err = s.PutMany(ctx, map[string][]byte{"app/host": []byte("db.local"), "": []byte("1")})
+	assert.EqualError(t, err, "consul: transaction rolled back: : invalid operation")
+	v, err := s.Get(ctx, "app/host")
+	require.NoError(t, err)
+	assert.Equal(t, "db.remote", string(v))
+
+	many := map[string][]byte{"app/host": []byte("db.local")}
+	for i := 0; i < MaxTxnOps; i++ {
+		many[fmt.Sprintf("app/key%d", i)] = []byte("1")
+	}
+	err = s.PutMany(ctx, many)
+	assert.ErrorIs(t, err, backend.ErrTxnTooLarge)
+	assert.EqualError(t, err, "consul: 65 keys, at most 64: too many keys for a single transaction")
+	v, err = s.Get(ctx, "app/host")
+	require.NoError(t, err)
+	assert.Equal(t, "db.remote", string(v))
+}
+
+func TestFailoverDoesNotBlock(t *testing.T) {
+	f := newFakeCluster()
+	f.put("app/port", []byte("8080"))
+	a := f.agent(t, "10.0.0.1:8300")
+	probed := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(probed)
+		time.Sleep(500 * time.Millisecond)
+		json.NewEncoder(w).Encode("")
+	}))
+	defer slow.Close()
+	c := f.agent(t, "10.0.0.1:8300")
+	s, err := New([]string{a.URL, slow.URL, c.URL}, nil)
+	require.NoError(t, err)
+
+	stop(a)
+	done := make(chan error)
+	go func() {
+		_, err := s.Get(context.Background(), "app/port")
+		done <- err
+	}()
+	<-probed
+	// the other requests go on while the agents are checked
+	start := time.Now()
+	assert.Equal(t, a.URL, s.Endpoint())
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	require.NoError(t, <-done)
+	assert.Equal(t, c.URL, s.Endpoint())
+}
+
+func TestCanceledRequestDoesNotFailover(t *testing.T) {
+	f := newFakeCluster()
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hang.Close()
+	b := f.agent(t, "10.0.0.1:8300")
+	s, err := New([]string{hang.URL, b.URL}, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = s.Get(ctx, "app/port")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, hang.URL, s.Endpoint())
+	assert.False(t, isConnError(ctx, err))
+}
@@ -0,0 +1,326 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var (
+	// ErrNoEndpoints is returned when no endpoint is provided to New
+	ErrNoEndpoints = errors.New("etcd needs at least one endpoint")
+)
+
+func init() {
+	backend.Register("etcd", func(endpoints []string, cnf *backend.Config) (backend.Backend, error) {
+		return New(endpoints, cnf)
+	})
+}
+
+// EtcdBackend holds the configuration to connect to an etcd v3 cluster
+type EtcdBackend struct {
+	sync.Mutex
+	config clientv3.Config
+	client *clientv3.Client
+	prefix string
+	bucket string
+}
+
+// New create an etcd backend connection with the provided options. Every endpoint of the
+// cluster can be provided. It returns the created Backend or an error
+func New(endpoints []string, cnf *backend.Config) (*EtcdBackend, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	s := &EtcdBackend{}
+	s.config = clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	}
+
+	// Set options
+	if cnf != nil {
+		s.prefix = cnf.Prefix
+		s.bucket = cnf.Bucket
+		if cnf.TLS != nil {
+			s.config.TLS = cnf.TLS
+		} else if cnf.ClientTLS != nil {
+			tlsConfig, err := cnf.ClientTLS.TLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			s.config.TLS = tlsConfig
+		}
+		if cnf.ConnectionTimeout != 0 {
+			s.config.DialTimeout = cnf.ConnectionTimeout
+		}
+	}
+
+	// Creates a new client
+	client, err := clientv3.New(s.config)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+
+	return s, nil
+}
+
+// Close closes the connection to the etcd cluster
+func (s *EtcdBackend) Close() error {
+	return s.client.Close()
+}
+
+// GetPrefix return the defined prefix in the backend
+func (s *EtcdBackend) GetPrefix() string { return s.prefix }
+
+// GetBucket return the defined bucket in the backend
+func (s *EtcdBackend) GetBucket() string { return s.bucket }
+
+// SetWatchTimeDuration is a no-op as etcd watches are natively pushed by the server
+func (s *EtcdBackend) SetWatchTimeDuration(time time.Duration) {}
+
+// normalize removes the leading slash of key so the same layout is used as in the other backends
+func normalize(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+// Exists return true if key exists in backend and false otherwise
+func (s *EtcdBackend) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := s.client.Get(ctx, normalize(key), clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return resp.Count > 0, nil
+}
+
+// Get a value given its key
+// It is safe to provide a timeout by using context.Timeout.
+func (s *EtcdBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.client.Get(ctx, normalize(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// Put sets the value of key, creating it if it does not exist.
+// A TTL is implemented by attaching the key to a lease.
+func (s *EtcdBackend) Put(ctx context.Context, key string, value []byte, opts *backend.WriteOptions) error {
+	putOpts, err := s.putOptions(ctx, opts)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(ctx, normalize(key), string(value), putOpts...)
+	return err
+}
+
+// putOptions grants a lease for the TTL in opts, if any
+func (s *EtcdBackend) putOptions(ctx context.Context, opts *backend.WriteOptions) ([]clientv3.OpOption, error) {
+	if opts == nil || opts.TTL == 0 {
+		return nil, nil
+	}
+	ttl := int64(opts.TTL / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	lease, err := s.client.Grant(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return []clientv3.OpOption{clientv3.WithLease(lease.ID)}, nil
+}
+
+// Delete removes key. Deleting a key that does not exist is not an error.
+func (s *EtcdBackend) Delete(ctx context.Context, key string) error {
+	_, err := s.client.Delete(ctx, normalize(key))
+	return err
+}
+
+// DeleteTree removes all the keys under directory
+func (s *EtcdBackend) DeleteTree(ctx context.Context, directory string) error {
+	directory = normalize(directory)
+	if directory != "" && directory[len(directory)-1] != '/' {
+		directory += "/"
+	}
+	_, err := s.client.Delete(ctx, directory, clientv3.WithPrefix())
+	return err
+}
+
+// AtomicPut sets the value of key only if its ModRevision is still the LastIndex of previous.
+// A nil previous creates the key only if it does not exist.
+func (s *EtcdBackend) AtomicPut(ctx context.Context, key string, value []byte, previous *backend.KVPair, opts *backend.WriteOptions) (bool, *backend.KVPair, error) {
+	key = normalize(key)
+	putOpts, err := s.putOptions(ctx, opts)
+	if err != nil {
+		return false, nil, err
+	}
+	cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	if previous != nil {
+		cmp = clientv3.Compare(clientv3.ModRevision(key), "=", int64(previous.LastIndex))
+	}
+	resp, err := s.client.Txn(ctx).If(cmp).Then(clientv3.OpPut(key, string(value), putOpts...)).Commit()
+	if err != nil {
+		return false, nil, err
+	}
+	if !resp.Succeeded {
+		if previous == nil {
+			return false, nil, backend.ErrKeyExists
+		}
+		return false, nil, backend.ErrKeyModified
+	}
+	return true, &backend.KVPair{Key: key, Value: value, LastIndex: uint64(resp.Header.Revision)}, nil
+}
+
+// AtomicDelete removes key only if its ModRevision is still the LastIndex of previous
+func (s *EtcdBackend) AtomicDelete(ctx context.Context, key string, previous *backend.KVPair) (bool, error) {
+	if previous == nil {
+		return false, backend.ErrPreviousNotSpecified
+	}
+	key = normalize(key)
+	resp, err := s.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(previous.LastIndex))).
+		Then(clientv3.OpDelete(key)).
+		Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if !resp.Succeeded {
+		if resp.Responses[0].GetResponseRange().Count == 0 {
+			return false, backend.ErrKeyNotFound
+		}
+		return false, backend.ErrKeyModified
+	}
+	return true, nil
+}
+
+// List will get all keypairs under a prefix
+// It is safe to provide a timeout by using context.Timeout.
+func (s *EtcdBackend) List(ctx context.Context, key string) ([]*backend.KVPair, error) {
+	pairs, _, err := s.list(ctx, normalize(key), 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+// list returns the keypairs under prefix at revision rev (0 is the current one) along with
+// the revision of the store when read.
+func (s *EtcdBackend) list(ctx context.Context, prefix string, rev int64) ([]*backend.KVPair, int64, error) {
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+	resp, err := s.client.Get(ctx, prefix, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	ret := []*backend.KVPair{}
+	for _, kv := range resp.Kvs {
+		ret = append(ret, &backend.KVPair{Key: string(kv.Key), Value: kv.Value, LastIndex: uint64(kv.ModRevision)})
+	}
+	return ret, resp.Header.Revision, nil
+}
+
+// Watch listens for changes on a "key"
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current value will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Deletions of the key are not sent.
+func (s *EtcdBackend) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	key = normalize(key)
+	resp, err := s.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+
+	respChan := make(chan []byte)
+	go func() {
+		defer close(respChan)
+		select {
+		case respChan <- resp.Kvs[0].Value:
+		case <-ctx.Done():
+			return
+		}
+		wch := s.client.Watch(ctx, key, clientv3.WithRev(resp.Header.Revision+1))
+		for wresp := range wch {
+			if wresp.Err() != nil {
+				return
+			}
+			for _, ev := range wresp.Events {
+				if ev.Type != clientv3.EventTypePut {
+					continue
+				}
+				select {
+				case respChan <- ev.Kv.Value:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return respChan, nil
+}
+
+// WatchTree listens for changes on a "tree".
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current values will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Every change sends all the keypairs in the tree, as they are at the revision of the change.
+func (s *EtcdBackend) WatchTree(ctx context.Context, directory string) (<-chan []*backend.KVPair, error) {
+	directory = normalize(directory)
+	if directory != "" && directory[len(directory)-1] != '/' {
+		directory += "/"
+	}
+	pairs, rev, err := s.list(ctx, directory, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	respCh := make(chan []*backend.KVPair)
+	go func() {
+		defer close(respCh)
+		select {
+		case respCh <- pairs:
+		case <-ctx.Done():
+			return
+		}
+		wch := s.client.Watch(ctx, directory, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for wresp := range wch {
+			if wresp.Err() != nil {
+				return
+			}
+			if len(wresp.Events) == 0 {
+				continue
+			}
+			pairs, _, err := s.list(ctx, directory, wresp.Header.Revision)
+			if err != nil {
+				return
+			}
+			select {
+			case respCh <- pairs:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return respCh, nil
+}
@@ -0,0 +1,60 @@
+package etcd
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEtcd runs an embedded etcd server and returns its client endpoint
+func startEtcd(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "getconf-etcd")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("unix://" + dir + "/client.sock")
+	peerURL, _ := url.Parse("unix://" + dir + "/peer.sock")
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.Name + "=" + peerURL.String()
+
+	e, err := embed.StartEtcd(cfg)
+	require.NoError(t, err)
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd server took too long to start")
+	}
+	return clientURL.String()
+}
+
+func newTestBackend(t *testing.T) *EtcdBackend {
+	s, err := New([]string{startEtcd(t)}, &backend.Config{ConnectionTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		return &backendtest.Store{Backend: newTestBackend(t)}
+	})
+}
+
+func TestRegistered(t *testing.T) {
+	assert.Contains(t, backend.Backends(), "etcd")
+}
@@ -0,0 +1,514 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jllopis/getconf/backend"
+)
+
+var (
+	// ErrMultipleEndpointsUnsupported is thrown when there are
+	// multiple root directories specified
+	ErrMultipleEndpointsUnsupported = errors.New("fs does not support multiple root directories")
+	// ErrNoEndpoints is returned when no root directory is provided to New
+	ErrNoEndpoints = errors.New("fs needs a root directory")
+	// ErrInvalidKey is returned when a key points outside the root directory
+	ErrInvalidKey = errors.New("key outside of the root directory")
+)
+
+func init() {
+	backend.Register("fs", func(endpoints []string, cnf *backend.Config) (backend.Backend, error) {
+		return New(endpoints, cnf)
+	})
+}
+
+// FSBackend stores every key as a file under a root directory: the key "store/host" is the
+// file root/store/host and its content the value. The modification time of the file, in
+// nanoseconds, is used as LastIndex.
+//
+// Watches use inotify (or the native notification system of the platform).
+type FSBackend struct {
+	sync.Mutex
+	root   string
+	prefix string
+	bucket string
+}
+
+// New create a filesystem backend rooted at the directory in endpoints, which must exist.
+// It returns the created Backend or an error
+func New(endpoints []string, cnf *backend.Config) (*FSBackend, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if len(endpoints) > 1 {
+		return nil, ErrMultipleEndpointsUnsupported
+	}
+	root, err := filepath.Abs(strings.TrimPrefix(endpoints[0], "file://"))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.New(root + " is not a directory")
+	}
+
+	s := &FSBackend{root: root}
+	if cnf != nil {
+		s.prefix = cnf.Prefix
+		s.bucket = cnf.Bucket
+	}
+	return s, nil
+}
+
+// GetPrefix return the defined prefix in the backend
+func (s *FSBackend) GetPrefix() string { return s.prefix }
+
+// GetBucket return the defined bucket in the backend
+func (s *FSBackend) GetBucket() string { return s.bucket }
+
+// SetWatchTimeDuration is a no-op as changes are notified by the filesystem
+func (s *FSBackend) SetWatchTimeDuration(time time.Duration) {}
+
+// path returns the file path for key
+func (s *FSBackend) path(key string) (string, error) {
+	p := filepath.Join(s.root, filepath.FromSlash(strings.Trim(key, "/")))
+	if p != s.root && !strings.HasPrefix(p, s.root+string(filepath.Separator)) {
+		return "", ErrInvalidKey
+	}
+	return p, nil
+}
+
+// key returns the key for the file at path p
+func (s *FSBackend) key(p string) string {
+	rel, _ := filepath.Rel(s.root, p)
+	return filepath.ToSlash(rel)
+}
+
+// Exists return true if key exists in backend and false otherwise
+func (s *FSBackend) Exists(ctx context.Context, key string) (bool, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode().IsRegular(), nil
+}
+
+// Get a value given its key
+// It is safe to provide a timeout by using context.Timeout.
+func (s *FSBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, backend.ErrKeyNotFound
+	}
+	if err != nil {
+		if fi, serr := os.Stat(p); serr == nil && fi.IsDir() {
+			return nil, backend.ErrKeyNotFound
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// Put sets the value of key, creating it and its parent directories if they do not exist.
+// The file is replaced atomically. TTLs are not supported.
+func (s *FSBackend) Put(ctx context.Context, key string, value []byte, opts *backend.WriteOptions) error {
+	if opts != nil && opts.TTL != 0 {
+		return backend.ErrNotSupported
+	}
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.write(p, value)
+	return err
+}
+
+// write replaces the file p with value and returns its new LastIndex. The modification time is
+// moved forward if needed so it always grows, even if the clock of the filesystem is coarser
+// than the writes.
+func (s *FSBackend) write(p string, value []byte) (uint64, error) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	mtime := fi.ModTime()
+	if old, err := os.Stat(p); err == nil && !mtime.After(old.ModTime()) {
+		mtime = old.ModTime().Add(time.Nanosecond)
+		if err := os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return 0, err
+	}
+	return uint64(mtime.UnixNano()), nil
+}
+
+// Delete removes the file of key. Deleting a key that does not exist is not an error.
+func (s *FSBackend) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteTree removes the directory of directory and all the files under it
+func (s *FSBackend) DeleteTree(ctx context.Context, directory string) error {
+	dir, err := s.path(directory)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if dir != s.root {
+		return os.RemoveAll(dir)
+	}
+	// the root directory itself is kept
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastIndex returns the LastIndex of the file p or ErrKeyNotFound if it does not exist
+func lastIndex(p string) (uint64, error) {
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && !fi.Mode().IsRegular()) {
+		return 0, backend.ErrKeyNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fi.ModTime().UnixNano()), nil
+}
+
+// AtomicPut sets the value of key only if the modification time of its file is still the
+// LastIndex of previous. A nil previous creates the key only if it does not exist.
+//
+// The operations are only atomic among the writes of this FSBackend, other processes writing the
+// files are not detected until they change the modification time.
+func (s *FSBackend) AtomicPut(ctx context.Context, key string, value []byte, previous *backend.KVPair, opts *backend.WriteOptions) (bool, *backend.KVPair, error) {
+	if opts != nil && opts.TTL != 0 {
+		return false, nil, backend.ErrNotSupported
+	}
+	p, err := s.path(key)
+	if err != nil {
+		return false, nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	index, err := lastIndex(p)
+	switch {
+	case err == backend.ErrKeyNotFound:
+		if previous != nil {
+			return false, nil, backend.ErrKeyNotFound
+		}
+	case err != nil:
+		return false, nil, err
+	case previous == nil:
+		return false, nil, backend.ErrKeyExists
+	case index != previous.LastIndex:
+		return false, nil, backend.ErrKeyModified
+	}
+	index, err = s.write(p, value)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, &backend.KVPair{Key: s.key(p), Value: value, LastIndex: index}, nil
+}
+
+// AtomicDelete removes key only if the modification time of its file is still the LastIndex of
+// previous. As AtomicPut, it is only atomic among the writes of this FSBackend.
+func (s *FSBackend) AtomicDelete(ctx context.Context, key string, previous *backend.KVPair) (bool, error) {
+	if previous == nil {
+		return false, backend.ErrPreviousNotSpecified
+	}
+	p, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	index, err := lastIndex(p)
+	if err != nil {
+		return false, err
+	}
+	if index != previous.LastIndex {
+		return false, backend.ErrKeyModified
+	}
+	if err := os.Remove(p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// List will get all keypairs under a prefix
+// It is safe to provide a timeout by using context.Timeout.
+func (s *FSBackend) List(ctx context.Context, key string) ([]*backend.KVPair, error) {
+	pairs, err := s.list(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+// list walks the directory for key and returns the keypairs found, sorted by key. Hidden files
+// are skipped.
+func (s *FSBackend) list(key string) ([]*backend.KVPair, error) {
+	dir, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*backend.KVPair{}
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), ".") && p != dir {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		ret = append(ret, &backend.KVPair{Key: s.key(p), Value: b, LastIndex: uint64(fi.ModTime().UnixNano())})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret, nil
+}
+
+// addWatches adds dir and every directory below it to w. If dir does not exist, its closest
+// existing parent inside the root is watched instead so its creation is noticed.
+func (s *FSBackend) addWatches(w *fsnotify.Watcher, dir string) error {
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == s.root {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			return w.Add(p)
+		}
+		return nil
+	})
+}
+
+// Watch listens for changes on a "key"
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current value will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Deletions of the key are not sent.
+func (s *FSBackend) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// The directory is watched so files replaced by a rename are followed
+	if err := w.Add(filepath.Dir(p)); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	respChan := make(chan []byte)
+	go func() {
+		defer close(respChan)
+		defer w.Close()
+		val := current
+		for {
+			select {
+			case respChan <- val:
+			case <-ctx.Done():
+				return
+			}
+			for changed := false; !changed; {
+				select {
+				case <-ctx.Done():
+					return
+				case _, ok := <-w.Errors:
+					if !ok {
+						return
+					}
+				case ev, ok := <-w.Events:
+					if !ok {
+						return
+					}
+					if ev.Name != p || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+						continue
+					}
+					v, err := s.Get(ctx, key)
+					if err != nil || bytes.Equal(v, val) {
+						continue
+					}
+					val, changed = v, true
+				}
+			}
+		}
+	}()
+	return respChan, nil
+}
+
+// WatchTree listens for changes on a "tree".
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current values will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Every change sends all the keypairs in the tree.
+func (s *FSBackend) WatchTree(ctx context.Context, directory string) (<-chan []*backend.KVPair, error) {
+	dir, err := s.path(directory)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.list(directory)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addWatches(w, dir); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	respCh := make(chan []*backend.KVPair)
+	go func() {
+		defer close(respCh)
+		defer w.Close()
+		pairs := current
+		for {
+			select {
+			case respCh <- pairs:
+			case <-ctx.Done():
+				return
+			}
+			for changed := false; !changed; {
+				select {
+				case <-ctx.Done():
+					return
+				case _, ok := <-w.Errors:
+					if !ok {
+						return
+					}
+				case ev, ok := <-w.Events:
+					if !ok {
+						return
+					}
+					if ev.Op&fsnotify.Create != 0 {
+						s.addWatches(w, dir)
+					}
+					p, err := s.list(directory)
+					if err != nil || equalPairs(p, pairs) {
+						continue
+					}
+					pairs, changed = p, true
+				}
+			}
+		}
+	}()
+	return respCh, nil
+}
+
+// equalPairs returns true if a and b hold the same keys and values
+func equalPairs(a, b []*backend.KVPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBackend(t *testing.T) *FSBackend {
+	dir, err := ioutil.TempDir("", "getconf-fs")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := New([]string{dir}, &backend.Config{})
+	require.NoError(t, err)
+	return s
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		return &backendtest.Store{Backend: newTestBackend(t)}
+	})
+}
+
+func TestFiles(t *testing.T) {
+	s := newTestBackend(t)
+	ctx := context.Background()
+
+	require.NoError(t, s.Put(ctx, "/settings/apps/test/v1/store/host", []byte("db.local"), nil))
+	assert.FileExists(t, filepath.Join(s.root, "settings", "apps", "test", "v1", "store", "host"))
+
+	_, err := s.Get(ctx, "../../etc/passwd")
+	assert.Equal(t, ErrInvalidKey, err)
+}
+
+func TestWatchTreeNewDir(t *testing.T) {
+	s := newTestBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := s.WatchTree(ctx, "app/v1")
+	require.NoError(t, err)
+	assert.Len(t, <-ch, 0)
+
+	// keys in directories that do not exist yet are noticed too
+	require.NoError(t, s.Put(ctx, "app/v1/store/host", []byte("localhost"), nil))
+	select {
+	case pairs := <-ch:
+		require.Len(t, pairs, 1)
+		assert.Equal(t, "app/v1/store/host", pairs[0].Key)
+		assert.Equal(t, "localhost", string(pairs[0].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+
+	require.NoError(t, os.Remove(filepath.Join(s.root, "app", "v1", "store", "host")))
+	select {
+	case pairs := <-ch:
+		assert.Len(t, pairs, 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
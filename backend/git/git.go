@@ -0,0 +1,577 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	pathpkg "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+)
+
+var (
+	// ErrMultipleEndpointsUnsupported is thrown when there are
+	// multiple endpoints specified for Git
+	ErrMultipleEndpointsUnsupported = errors.New("git does not support multiple endpoints")
+	// ErrNoEndpoints is returned when no endpoint is provided to New
+	ErrNoEndpoints = errors.New("git needs a repository")
+
+	defaultWatchTimeDuration = 30 * time.Second
+)
+
+func init() {
+	backend.Register("git", func(endpoints []string, cnf *backend.Config) (backend.Backend, error) {
+		return New(endpoints, cnf)
+	})
+}
+
+// Options holds the Git specific options
+type Options struct {
+	Branch string // branch to follow. Defaults to the default branch of the repository
+	Path   string // directory of the repository holding the keys. Defaults to the root
+	Dir    string // directory of the local clone. Defaults to a temporary one removed by Close
+}
+
+// GitBackend serves the files of a Git repository as keypairs. The key "settings/apps/gcv2/v1/port"
+// is the content of the file "settings/apps/gcv2/v1/port" under Options.Path.
+//
+// A mirror of the repository is kept in a local directory and fetched at most once every
+// SetWatchTimeDuration. The tip of Options.Branch is served unless the Bucket of the
+// backend.Config pins a tag or a commit. The first 64 bits of the commit SHA served are used as
+// LastIndex and Commit returns the full SHA.
+//
+// It needs the git command to be installed.
+type GitBackend struct {
+	sync.Mutex
+	opts      Options
+	temp      bool
+	commit    string
+	fetched   time.Time
+	watchTime time.Duration
+	prefix    string
+	bucket    string
+}
+
+// New clones the repository in endpoints. It returns the created Backend or an error.
+//
+// The endpoint is anything git clone accepts, a local path or a URL. The Options can be set as
+// query params (branch, path and dir) after a '?':
+//
+//	https://github.com/org/config.git?branch=main&path=apps
+func New(endpoints []string, cnf *backend.Config) (*GitBackend, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if len(endpoints) > 1 {
+		return nil, ErrMultipleEndpointsUnsupported
+	}
+	repo := endpoints[0]
+	opts := Options{}
+	if i := strings.LastIndex(repo, "?"); i >= 0 {
+		q, err := url.ParseQuery(repo[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		opts.Branch = q.Get("branch")
+		opts.Path = q.Get("path")
+		opts.Dir = q.Get("dir")
+		repo = repo[:i]
+	}
+	return NewWithOptions(repo, opts, cnf)
+}
+
+// NewWithOptions clones the repository at repo into opts.Dir, or fetches it if it has already
+// been cloned there, and resolves the commit to serve.
+func NewWithOptions(repo string, opts Options, cnf *backend.Config) (*GitBackend, error) {
+	if repo == "" {
+		return nil, ErrNoEndpoints
+	}
+	opts.Path = strings.Trim(opts.Path, "/")
+	s := &GitBackend{opts: opts, watchTime: defaultWatchTimeDuration}
+	if cnf != nil {
+		s.prefix = cnf.Prefix
+		s.bucket = cnf.Bucket
+	}
+
+	ctx := context.Background()
+	if cnf != nil && cnf.ConnectionTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cnf.ConnectionTimeout)
+		defer cancel()
+	}
+
+	if s.opts.Dir == "" {
+		dir, err := ioutil.TempDir("", "getconf-git")
+		if err != nil {
+			return nil, err
+		}
+		s.opts.Dir = dir
+		s.temp = true
+	}
+	if _, err := os.Stat(filepath.Join(s.opts.Dir, "HEAD")); err == nil {
+		if _, err := s.git(ctx, nil, "remote", "set-url", "origin", repo); err != nil {
+			return nil, err
+		}
+		if _, err := s.git(ctx, nil, "fetch", "--prune", "--quiet", "origin"); err != nil {
+			return nil, err
+		}
+	} else if _, err := s.git(ctx, nil, "clone", "--mirror", "--quiet", repo, s.opts.Dir); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if _, err := s.current(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close removes the local clone if it is temporary
+func (s *GitBackend) Close() error {
+	if s.temp {
+		return os.RemoveAll(s.opts.Dir)
+	}
+	return nil
+}
+
+// GetPrefix return the defined prefix in the backend
+func (s *GitBackend) GetPrefix() string { return s.prefix }
+
+// GetBucket return the defined bucket in the backend
+func (s *GitBackend) GetBucket() string { return s.bucket }
+
+// SetWatchTimeDuration sets the interval used to fetch the repository
+func (s *GitBackend) SetWatchTimeDuration(time time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.watchTime = time
+}
+
+// Commit returns the SHA of the commit being served
+func (s *GitBackend) Commit() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.commit
+}
+
+// git runs a git command in the local clone
+func (s *GitBackend) git(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	if args[0] != "clone" {
+		cmd.Dir = s.opts.Dir
+	}
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, &gitError{args: args, err: err, stderr: strings.TrimSpace(stderr.String())}
+	}
+	return out, nil
+}
+
+// gitError is returned when a git command fails
+type gitError struct {
+	args   []string
+	err    error
+	stderr string
+}
+
+func (e *gitError) Error() string {
+	return fmt.Sprintf("git %s: %v: %s", e.args[0], e.err, e.stderr)
+}
+
+// current returns the commit to serve, fetching the repository if the last fetch is older than
+// the watch time duration.
+func (s *GitBackend) current(ctx context.Context) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.commit != "" && time.Since(s.fetched) < s.watchTime {
+		return s.commit, nil
+	}
+	if !s.fetched.IsZero() {
+		if _, err := s.git(ctx, nil, "fetch", "--prune", "--quiet", "origin"); err != nil {
+			return "", err
+		}
+	}
+	ref := "HEAD"
+	if s.bucket != "" {
+		ref = s.bucket
+	} else if s.opts.Branch != "" {
+		ref = "refs/heads/" + s.opts.Branch
+	}
+	out, err := s.git(ctx, nil, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		if isExit(err, 1) {
+			return "", fmt.Errorf("git: revision %s not found", ref)
+		}
+		return "", err
+	}
+	s.commit = strings.TrimSpace(string(out))
+	s.fetched = time.Now()
+	return s.commit, nil
+}
+
+// isExit returns true if err is a git command that exited with code
+func isExit(err error, code int) bool {
+	if e, ok := err.(*gitError); ok {
+		if ee, ok := e.err.(*exec.ExitError); ok {
+			return ee.ExitCode() == code
+		}
+	}
+	return false
+}
+
+// commitIndex returns the first 64 bits of the commit SHA, used as LastIndex
+func commitIndex(commit string) uint64 {
+	if len(commit) > 16 {
+		commit = commit[:16]
+	}
+	idx, _ := strconv.ParseUint(commit, 16, 64)
+	return idx
+}
+
+// path returns the path in the repository of key.
+//
+// When the backend is pinned, the Bucket element that getconf adds to the keys after the Prefix
+// and the set name is removed, as the revision is already selected by it: with Prefix "settings"
+// and Bucket "v1.2.0", the key "settings/gcv2/v1.2.0/port" is the file "settings/gcv2/port" at
+// the tag v1.2.0.
+func (s *GitBackend) path(key string) string {
+	key = strings.Trim(key, "/")
+	if s.bucket != "" {
+		elems := strings.Split(key, "/")
+		i := 1 // skip the set name
+		if p := strings.Trim(s.prefix, "/"); p != "" {
+			i += len(strings.Split(p, "/"))
+		}
+		if i < len(elems) {
+			rest := strings.Join(elems[i:], "/")
+			if rest == s.bucket || strings.HasPrefix(rest, s.bucket+"/") {
+				key = strings.Trim(strings.Join(elems[:i], "/")+"/"+strings.TrimPrefix(rest, s.bucket), "/")
+			}
+		}
+	}
+	return strings.Trim(pathpkg.Join(s.opts.Path, key), "/")
+}
+
+// object returns the type and id of the object at path in commit
+func (s *GitBackend) object(ctx context.Context, commit, path string) (string, string, error) {
+	if path == "" {
+		out, err := s.git(ctx, nil, "rev-parse", commit+"^{tree}")
+		if err != nil {
+			return "", "", err
+		}
+		return "tree", strings.TrimSpace(string(out)), nil
+	}
+	out, err := s.git(ctx, nil, "ls-tree", "-z", commit, "--", path)
+	if err != nil {
+		return "", "", err
+	}
+	// <mode> SP <type> SP <object> TAB <file>
+	fields := strings.Fields(strings.SplitN(string(out), "\t", 2)[0])
+	if len(fields) != 3 {
+		return "", "", backend.ErrKeyNotFound
+	}
+	return fields[1], fields[2], nil
+}
+
+// blob returns the id of the file at key in commit
+func (s *GitBackend) blob(ctx context.Context, commit, key string) (string, error) {
+	typ, id, err := s.object(ctx, commit, s.path(key))
+	if err != nil {
+		return "", err
+	}
+	if typ != "blob" {
+		return "", backend.ErrKeyNotFound
+	}
+	return id, nil
+}
+
+// read returns the contents of the blobs in ids
+func (s *GitBackend) read(ctx context.Context, ids ...string) ([][]byte, error) {
+	out, err := s.git(ctx, strings.NewReader(strings.Join(ids, "\n")+"\n"), "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(bytes.NewReader(out))
+	ret := make([][]byte, 0, len(ids))
+	for range ids {
+		// <object> SP <type> SP <size> LF <contents> LF
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("git cat-file: unexpected output %q", header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		ret = append(ret, data[:size])
+	}
+	return ret, nil
+}
+
+// Exists return true if key exists in backend and false otherwise
+func (s *GitBackend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Get(ctx, key)
+	if err != nil {
+		if err == backend.ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Get a value given its key
+// It is safe to provide a timeout by using context.Timeout.
+func (s *GitBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	commit, err := s.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.blob(ctx, commit, key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return data[0], nil
+}
+
+// List will get all keypairs under a prefix
+// It is safe to provide a timeout by using context.Timeout.
+func (s *GitBackend) List(ctx context.Context, key string) ([]*backend.KVPair, error) {
+	commit, err := s.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := s.list(ctx, commit, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+// list returns the files under the directory key in commit sorted by key
+func (s *GitBackend) list(ctx context.Context, commit, key string) ([]*backend.KVPair, error) {
+	dir := s.path(key)
+	args := []string{"ls-tree", "-r", "-z", commit}
+	if dir != "" {
+		args = append(args, "--", dir+"/")
+	}
+	out, err := s.git(ctx, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	key = strings.Trim(key, "/")
+	var keys, ids []string
+	for _, line := range strings.Split(string(out), "\x00") {
+		parts := strings.SplitN(line, "\t", 2)
+		fields := strings.Fields(parts[0])
+		if len(parts) != 2 || len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(parts[1], dir), "/")
+		keys = append(keys, strings.TrimPrefix(key+"/"+rel, "/"))
+		ids = append(ids, fields[2])
+	}
+	ret := []*backend.KVPair{}
+	if len(ids) == 0 {
+		return ret, nil
+	}
+	values, err := s.read(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	idx := commitIndex(commit)
+	for i := range keys {
+		ret = append(ret, &backend.KVPair{Key: keys[i], Value: values[i], LastIndex: idx})
+	}
+	return ret, nil
+}
+
+// Put is not supported, the repository is served read only
+func (s *GitBackend) Put(ctx context.Context, key string, value []byte, opts *backend.WriteOptions) error {
+	return backend.ErrNotSupported
+}
+
+// Delete is not supported, the repository is served read only
+func (s *GitBackend) Delete(ctx context.Context, key string) error {
+	return backend.ErrNotSupported
+}
+
+// DeleteTree is not supported, the repository is served read only
+func (s *GitBackend) DeleteTree(ctx context.Context, directory string) error {
+	return backend.ErrNotSupported
+}
+
+// AtomicPut is not supported, the repository is served read only
+func (s *GitBackend) AtomicPut(ctx context.Context, key string, value []byte, previous *backend.KVPair, opts *backend.WriteOptions) (bool, *backend.KVPair, error) {
+	return false, nil, backend.ErrNotSupported
+}
+
+// AtomicDelete is not supported, the repository is served read only
+func (s *GitBackend) AtomicDelete(ctx context.Context, key string, previous *backend.KVPair) (bool, error) {
+	return false, backend.ErrNotSupported
+}
+
+// Watch listens for changes on a "key"
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current value will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// The repository is fetched every SetWatchTimeDuration and the value is sent when the file changes.
+func (s *GitBackend) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	commit, err := s.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.blob(ctx, commit, key)
+	if err != nil {
+		return nil, err
+	}
+
+	respChan := make(chan []byte)
+	go func() {
+		defer close(respChan)
+		for {
+			data, err := s.read(ctx, id)
+			if err != nil {
+				return
+			}
+			select {
+			case respChan <- data[0]:
+			case <-ctx.Done():
+				return
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(s.watchTimeDuration()):
+				}
+				commit, err := s.current(ctx)
+				if err != nil {
+					return
+				}
+				i, err := s.blob(ctx, commit, key)
+				if err == backend.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					return
+				}
+				if i != id {
+					id = i
+					break
+				}
+			}
+		}
+	}()
+	return respChan, nil
+}
+
+// WatchTree listens for changes on a "tree".
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current values will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// The repository is fetched every SetWatchTimeDuration and all the keypairs of the tree are sent
+// when any file under it changes.
+func (s *GitBackend) WatchTree(ctx context.Context, directory string) (<-chan []*backend.KVPair, error) {
+	commit, err := s.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := s.list(ctx, commit, directory)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := s.tree(ctx, commit, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	respCh := make(chan []*backend.KVPair)
+	go func() {
+		defer close(respCh)
+		for {
+			select {
+			case respCh <- pairs:
+			case <-ctx.Done():
+				return
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(s.watchTimeDuration()):
+				}
+				commit, err := s.current(ctx)
+				if err != nil {
+					return
+				}
+				t, err := s.tree(ctx, commit, directory)
+				if err != nil {
+					return
+				}
+				if t == tree {
+					continue
+				}
+				p, err := s.list(ctx, commit, directory)
+				if err != nil {
+					return
+				}
+				pairs, tree = p, t
+				break
+			}
+		}
+	}()
+	return respCh, nil
+}
+
+// tree returns the id of the directory key in commit or an empty string if it does not exist
+func (s *GitBackend) tree(ctx context.Context, commit, key string) (string, error) {
+	typ, id, err := s.object(ctx, commit, s.path(key))
+	if err == backend.ErrKeyNotFound {
+		return "", nil
+	}
+	if err != nil || typ != "tree" {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *GitBackend) watchTimeDuration() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.watchTime
+}
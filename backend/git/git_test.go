@@ -0,0 +1,153 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRepo is a bare repository along with a working copy used to push commits to it
+type testRepo struct {
+	t    *testing.T
+	bare string
+	work string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	dir, err := ioutil.TempDir("", "getconf-git")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	r := &testRepo{t: t, bare: filepath.Join(dir, "config.git"), work: filepath.Join(dir, "work")}
+	r.run(dir, "init", "--quiet", "--bare", "--initial-branch=main", r.bare)
+	r.run(dir, "init", "--quiet", "--initial-branch=main", r.work)
+	r.run(r.work, "remote", "add", "origin", r.bare)
+	return r
+}
+
+func (r *testRepo) run(dir string, args ...string) string {
+	args = append([]string{"-c", "user.name=getconf", "-c", "user.email=getconf@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	require.NoError(r.t, err, string(out))
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes files in the working copy and pushes them. An empty value removes the file.
+func (r *testRepo) commit(files map[string]string) string {
+	for name, value := range files {
+		path := filepath.Join(r.work, filepath.FromSlash(name))
+		if value == "" {
+			require.NoError(r.t, os.Remove(path))
+			continue
+		}
+		require.NoError(r.t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(r.t, ioutil.WriteFile(path, []byte(value), 0644))
+	}
+	r.run(r.work, "add", "-A")
+	r.run(r.work, "commit", "--quiet", "-m", "update")
+	r.run(r.work, "push", "--quiet", "--tags", "origin", "main")
+	return r.run(r.work, "rev-parse", "HEAD")
+}
+
+func newTestBackend(t *testing.T, repo string, cnf *backend.Config) *GitBackend {
+	s, err := New([]string{repo}, cnf)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		r := newTestRepo(t)
+		r.commit(map[string]string{"README.md": "not a key"})
+		s := newTestBackend(t, r.bare, &backend.Config{})
+		s.SetWatchTimeDuration(10 * time.Millisecond)
+		return &backendtest.Store{Backend: s, Set: func(kvs map[string]string) { r.commit(kvs) }}
+	})
+}
+
+func TestPath(t *testing.T) {
+	r := newTestRepo(t)
+	sha := r.commit(map[string]string{
+		"config/settings/apps/test/v1/port": "8080",
+		"README.md":                         "not a key",
+	})
+	s := newTestBackend(t, r.bare+"?path=config", &backend.Config{})
+	ctx := context.Background()
+	assert.Equal(t, sha, s.Commit())
+
+	v, err := s.Get(ctx, "/settings/apps/test/v1/port")
+	assert.NoError(t, err)
+	assert.Equal(t, "8080", string(v))
+	_, err = s.Get(ctx, "/README.md")
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+
+	pairs, err := s.List(ctx, "/settings/apps/test/v1")
+	require.NoError(t, err)
+	require.Len(t, pairs, 1)
+	assert.Equal(t, commitIndex(sha), pairs[0].LastIndex)
+}
+
+func TestPinned(t *testing.T) {
+	r := newTestRepo(t)
+	sha := r.commit(map[string]string{"settings/test/port": "8000"})
+	r.run(r.work, "tag", "v1")
+	r.commit(map[string]string{"settings/test/port": "9000"})
+
+	// the bucket selects the tag and is not part of the path of the file
+	s := newTestBackend(t, r.bare, &backend.Config{Prefix: "/settings", Bucket: "v1"})
+	v, err := s.Get(context.Background(), "/settings/test/v1/port")
+	require.NoError(t, err)
+	assert.Equal(t, "8000", string(v))
+	assert.Equal(t, sha, s.Commit())
+
+	s = newTestBackend(t, r.bare, &backend.Config{Prefix: "/settings", Bucket: sha[:12]})
+	pairs, err := s.List(context.Background(), "/settings/test/"+sha[:12])
+	require.NoError(t, err)
+	require.Len(t, pairs, 1)
+	assert.Equal(t, "settings/test/"+sha[:12]+"/port", pairs[0].Key)
+	assert.Equal(t, "8000", string(pairs[0].Value))
+
+	_, err = New([]string{r.bare}, &backend.Config{Bucket: "v2"})
+	assert.Error(t, err)
+}
+
+func TestWatchTreeRemoved(t *testing.T) {
+	r := newTestRepo(t)
+	r.commit(map[string]string{"app/debug": "false", "app/v1/host": "localhost"})
+	dir, err := ioutil.TempDir("", "getconf-git-clone")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := newTestBackend(t, r.bare+"?branch=main&dir="+dir, &backend.Config{})
+	s.SetWatchTimeDuration(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tree, err := s.WatchTree(ctx, "app/v1")
+	require.NoError(t, err)
+	assert.Len(t, <-tree, 1)
+
+	r.commit(map[string]string{"app/v1/host": "", "app/v1/port": "8080"})
+	select {
+	case pairs := <-tree:
+		require.Len(t, pairs, 1)
+		assert.Equal(t, "app/v1/port", pairs[0].Key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+
+	// the clone in dir is reused
+	s2 := newTestBackend(t, r.bare+"?dir="+dir, &backend.Config{})
+	assert.Equal(t, s.Commit(), s2.Commit())
+}
@@ -0,0 +1,669 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+)
+
+var (
+	// ErrMultipleEndpointsUnsupported is thrown when there are
+	// multiple endpoints specified for Kubernetes
+	ErrMultipleEndpointsUnsupported = errors.New("kubernetes does not support multiple endpoints")
+	// ErrNoEndpoints is returned when no endpoint is provided to New and getconf is not
+	// running in a cluster
+	ErrNoEndpoints = errors.New("kubernetes needs an endpoint")
+
+	errGone = errors.New("kubernetes: resource version too old")
+
+	// ServiceAccountDir is where the service account credentials are mounted in a pod
+	ServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	defaultWatchTimeDuration = 5 * time.Second
+)
+
+func init() {
+	backend.Register("kubernetes", func(endpoints []string, cnf *backend.Config) (backend.Backend, error) {
+		return New(endpoints, cnf)
+	})
+}
+
+// Options holds the Kubernetes specific options
+type Options struct {
+	Namespace string // namespace of the objects. Defaults to the namespace of the pod or "default"
+	ConfigMap string // name of the ConfigMap. Defaults to the set name
+	Secret    string // name of a Secret whose keys take precedence over the ConfigMap ones
+	Token     string // bearer token
+	TokenFile string // file holding the token, read on every request. Defaults to the service account one
+}
+
+// KubernetesBackend reads a ConfigMap, and optionally a Secret, from the API server.
+//
+// Every data key is an option with its dots replaced by '/': with Prefix "settings" and Bucket
+// "v1", the data key "store.host" read for the set name "gcv2" is the key
+// "settings/gcv2/v1/store/host". The resource version of the object is used as LastIndex.
+//
+// Watch and WatchTree use the watch API, so the changes arrive as soon as they are stored.
+type KubernetesBackend struct {
+	sync.Mutex
+	address   string
+	opts      Options
+	client    *http.Client
+	timeout   time.Duration
+	watchTime time.Duration
+	prefix    string
+	bucket    string
+}
+
+// New create a Kubernetes API client with the provided options. It returns the created Backend
+// or an error.
+//
+// The endpoint is the address of the API server. The Options can be set as query params
+// (namespace, configmap, secret and token_file) or from the environment variable
+// KUBERNETES_TOKEN:
+//
+//	https://kubernetes.default.svc?namespace=prod&configmap=gcv2&secret=gcv2-secrets
+//
+// An empty endpoint uses the service account of the pod getconf is running in.
+func New(endpoints []string, cnf *backend.Config) (*KubernetesBackend, error) {
+	if len(endpoints) > 1 {
+		return nil, ErrMultipleEndpointsUnsupported
+	}
+	address := ""
+	if len(endpoints) == 1 {
+		address = endpoints[0]
+	}
+	opts := Options{Token: os.Getenv("KUBERNETES_TOKEN")}
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		opts.Namespace = q.Get("namespace")
+		opts.ConfigMap = q.Get("configmap")
+		opts.Secret = q.Get("secret")
+		opts.TokenFile = q.Get("token_file")
+		u.RawQuery = ""
+		address = u.String()
+	}
+	return NewWithOptions(address, opts, cnf)
+}
+
+// NewWithOptions create a Kubernetes API client for the server at address. An empty address
+// uses the service account of the pod, taking the address from KUBERNETES_SERVICE_HOST and
+// KUBERNETES_SERVICE_PORT and the CA certificate from ServiceAccountDir.
+func NewWithOptions(address string, opts Options, cnf *backend.Config) (*KubernetesBackend, error) {
+	var tlsConfig *tls.Config
+	if address == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, ErrNoEndpoints
+		}
+		address = "https://" + host + ":" + port
+		if pem, err := ioutil.ReadFile(filepath.Join(ServiceAccountDir, "ca.crt")); err == nil {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(pem)
+			tlsConfig = &tls.Config{RootCAs: pool}
+		}
+	}
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	if opts.Token == "" && opts.TokenFile == "" {
+		if _, err := os.Stat(filepath.Join(ServiceAccountDir, "token")); err == nil {
+			opts.TokenFile = filepath.Join(ServiceAccountDir, "token")
+		}
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = "default"
+		if b, err := ioutil.ReadFile(filepath.Join(ServiceAccountDir, "namespace")); err == nil {
+			opts.Namespace = strings.TrimSpace(string(b))
+		}
+	}
+
+	s := &KubernetesBackend{
+		address:   strings.TrimSuffix(address, "/"),
+		opts:      opts,
+		client:    &http.Client{},
+		watchTime: defaultWatchTimeDuration,
+	}
+
+	// Set options
+	if cnf != nil {
+		s.prefix = cnf.Prefix
+		s.bucket = cnf.Bucket
+		if cnf.TLS != nil {
+			tlsConfig = cnf.TLS
+		} else if cnf.ClientTLS != nil {
+			var err error
+			if tlsConfig, err = cnf.ClientTLS.TLSConfig(); err != nil {
+				return nil, err
+			}
+		}
+		// the client is not given a timeout as it would close the watches
+		s.timeout = cnf.ConnectionTimeout
+	}
+	if tlsConfig != nil {
+		s.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	return s, nil
+}
+
+// GetPrefix return the defined prefix in the backend
+func (s *KubernetesBackend) GetPrefix() string { return s.prefix }
+
+// GetBucket return the defined bucket in the backend
+func (s *KubernetesBackend) GetBucket() string { return s.bucket }
+
+// SetWatchTimeDuration sets the time to wait before opening again a watch that failed
+func (s *KubernetesBackend) SetWatchTimeDuration(time time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.watchTime = time
+}
+
+func (s *KubernetesBackend) watchTimeDuration() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.watchTime
+}
+
+// object holds the fields used of a ConfigMap or a Secret
+type object struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data       map[string]string `json:"data"`
+	BinaryData map[string][]byte `json:"binaryData"`
+}
+
+// objectList is the response of a list request
+type objectList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []*object `json:"items"`
+}
+
+// watchEvent is every change sent by a watch request
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// resource identifies an object read by the backend
+type resource struct {
+	kind string // configmaps or secrets
+	name string
+}
+
+// resources returns the objects holding the options of app, the Secret last
+func (s *KubernetesBackend) resources(app string) []resource {
+	name := s.opts.ConfigMap
+	if name == "" {
+		name = app
+	}
+	ret := []resource{}
+	if name != "" {
+		ret = append(ret, resource{kind: "configmaps", name: name})
+	}
+	if s.opts.Secret != "" {
+		ret = append(ret, resource{kind: "secrets", name: s.opts.Secret})
+	}
+	return ret
+}
+
+// application returns the application of key, the element following the prefix
+func (s *KubernetesBackend) application(key string) string {
+	key = strings.Trim(key, "/")
+	if p := strings.Trim(s.prefix, "/"); p != "" {
+		if !strings.HasPrefix(key, p+"/") {
+			return ""
+		}
+		key = key[len(p)+1:]
+	}
+	return strings.SplitN(key, "/", 2)[0]
+}
+
+// request sends a GET request to the API server
+func (s *KubernetesBackend) request(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := s.address + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	token := s.opts.Token
+	if s.opts.TokenFile != "" {
+		b, err := ioutil.ReadFile(s.opts.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errGone
+		}
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return nil, fmt.Errorf("kubernetes: GET %s: %d %s", path, resp.StatusCode, status.Message)
+	}
+	return resp, nil
+}
+
+func (s *KubernetesBackend) path(r resource) string {
+	return "/api/v1/namespaces/" + url.PathEscape(s.opts.Namespace) + "/" + r.kind
+}
+
+// get returns the object r, or nil if it does not exist, and the resource version to watch it from
+func (s *KubernetesBackend) get(ctx context.Context, r resource) (*object, string, error) {
+	if s.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	resp, err := s.request(ctx, s.path(r), url.Values{"fieldSelector": {"metadata.name=" + r.name}})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var list objectList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	for _, o := range list.Items {
+		if o.Metadata.Name == r.name {
+			return o, list.Metadata.ResourceVersion, nil
+		}
+	}
+	return nil, list.Metadata.ResourceVersion, nil
+}
+
+// pairs returns the keypairs of app held by objs, sorted by key. A nil object is skipped.
+func (s *KubernetesBackend) pairs(app string, res []resource, objs []*object) []*backend.KVPair {
+	base := strings.TrimPrefix(s.prefix+"/"+app+"/"+s.bucket+"/", "/")
+	values := make(map[string]*backend.KVPair)
+	for i, o := range objs {
+		if o == nil {
+			continue
+		}
+		idx, _ := strconv.ParseUint(o.Metadata.ResourceVersion, 10, 64)
+		set := func(k string, v []byte) {
+			key := base + strings.Replace(k, ".", "/", -1)
+			values[key] = &backend.KVPair{Key: key, Value: v, LastIndex: idx}
+		}
+		for k, v := range o.BinaryData {
+			set(k, v)
+		}
+		for k, v := range o.Data {
+			if res[i].kind == "secrets" {
+				b, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					continue
+				}
+				set(k, b)
+				continue
+			}
+			set(k, []byte(v))
+		}
+	}
+	ret := make([]*backend.KVPair, 0, len(values))
+	for _, p := range values {
+		ret = append(ret, p)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// read returns the keypairs of app and the resource versions to watch its objects from
+func (s *KubernetesBackend) read(ctx context.Context, app string) ([]*backend.KVPair, []*object, []string, error) {
+	res := s.resources(app)
+	objs := make([]*object, len(res))
+	versions := make([]string, len(res))
+	for i, r := range res {
+		o, rv, err := s.get(ctx, r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		objs[i], versions[i] = o, rv
+	}
+	return s.pairs(app, res, objs), objs, versions, nil
+}
+
+// Exists return true if key exists in backend and false otherwise
+func (s *KubernetesBackend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Get(ctx, key)
+	if err != nil {
+		if err == backend.ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Get a value given its key
+// It is safe to provide a timeout by using context.Timeout.
+func (s *KubernetesBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	pairs, _, _, err := s.read(ctx, s.application(key))
+	if err != nil {
+		return nil, err
+	}
+	return lookup(pairs, key)
+}
+
+// lookup returns the value of key in pairs
+func lookup(pairs []*backend.KVPair, key string) ([]byte, error) {
+	key = strings.TrimPrefix(key, "/")
+	for _, p := range pairs {
+		if p.Key == key {
+			return p.Value, nil
+		}
+	}
+	return nil, backend.ErrKeyNotFound
+}
+
+// filter returns the pairs whose key starts with prefix
+func filter(pairs []*backend.KVPair, prefix string) []*backend.KVPair {
+	ret := []*backend.KVPair{}
+	for _, p := range pairs {
+		if strings.HasPrefix(p.Key, prefix) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// List will get all keypairs under a prefix
+// It is safe to provide a timeout by using context.Timeout.
+func (s *KubernetesBackend) List(ctx context.Context, key string) ([]*backend.KVPair, error) {
+	pairs, _, _, err := s.read(ctx, s.application(key))
+	if err != nil {
+		return nil, err
+	}
+	pairs = filter(pairs, strings.TrimPrefix(key, "/"))
+	if len(pairs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+// change is an object updated by a watch. A nil object has been deleted.
+type change struct {
+	index int
+	obj   *object
+}
+
+// watch reads the keypairs of app and watches its objects. It returns the current keypairs and
+// a channel receiving all of them after every change, closed when ctx is done.
+func (s *KubernetesBackend) watch(ctx context.Context, app string) ([]*backend.KVPair, <-chan []*backend.KVPair, error) {
+	pairs, objs, versions, err := s.read(ctx, app)
+	if err != nil {
+		return nil, nil, err
+	}
+	res := s.resources(app)
+	changes := make(chan change)
+	for i := range res {
+		go s.watchResource(ctx, i, res[i], versions[i], changes)
+	}
+
+	respCh := make(chan []*backend.KVPair)
+	go func() {
+		defer close(respCh)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case c := <-changes:
+				objs[c.index] = c.obj
+				select {
+				case respCh <- s.pairs(app, res, objs):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return pairs, respCh, nil
+}
+
+// watchResource sends to changes every update of r since the resource version rv. The watch is
+// opened again when the server closes it, reading the object again if rv is too old.
+func (s *KubernetesBackend) watchResource(ctx context.Context, index int, r resource, rv string, changes chan<- change) {
+	send := func(o *object) bool {
+		select {
+		case changes <- change{index: index, obj: o}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for {
+		err := s.stream(ctx, r, rv, func(typ string, o *object) bool {
+			rv = o.Metadata.ResourceVersion
+			switch typ {
+			case "ADDED", "MODIFIED":
+				return send(o)
+			case "DELETED":
+				return send(nil)
+			}
+			return true
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errGone {
+			var o *object
+			if o, rv, err = s.get(ctx, r); err == nil && !send(o) {
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(s.watchTimeDuration()):
+			}
+		}
+	}
+}
+
+// stream opens a watch on r and calls fn with every event until the server closes it or fn
+// returns false
+func (s *KubernetesBackend) stream(ctx context.Context, r resource, rv string, fn func(string, *object) bool) error {
+	q := url.Values{
+		"watch":               {"true"},
+		"fieldSelector":       {"metadata.name=" + r.name},
+		"resourceVersion":     {rv},
+		"allowWatchBookmarks": {"true"},
+	}
+	resp, err := s.request(ctx, s.path(r), q)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e watchEvent
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		if e.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(e.Object, &status)
+			if status.Code == http.StatusGone {
+				return errGone
+			}
+			return fmt.Errorf("kubernetes: watch %s: %s", r.name, status.Message)
+		}
+		var o object
+		if err := json.Unmarshal(e.Object, &o); err != nil {
+			return err
+		}
+		if !fn(e.Type, &o) {
+			return nil
+		}
+	}
+}
+
+// Put is not supported, the ConfigMap and Secret are read only
+func (s *KubernetesBackend) Put(ctx context.Context, key string, value []byte, opts *backend.WriteOptions) error {
+	return backend.ErrNotSupported
+}
+
+// Delete is not supported, the ConfigMap and Secret are read only
+func (s *KubernetesBackend) Delete(ctx context.Context, key string) error {
+	return backend.ErrNotSupported
+}
+
+// DeleteTree is not supported, the ConfigMap and Secret are read only
+func (s *KubernetesBackend) DeleteTree(ctx context.Context, directory string) error {
+	return backend.ErrNotSupported
+}
+
+// AtomicPut is not supported, the ConfigMap and Secret are read only
+func (s *KubernetesBackend) AtomicPut(ctx context.Context, key string, value []byte, previous *backend.KVPair, opts *backend.WriteOptions) (bool, *backend.KVPair, error) {
+	return false, nil, backend.ErrNotSupported
+}
+
+// AtomicDelete is not supported, the ConfigMap and Secret are read only
+func (s *KubernetesBackend) AtomicDelete(ctx context.Context, key string, previous *backend.KVPair) (bool, error) {
+	return false, backend.ErrNotSupported
+}
+
+// Watch listens for changes on a "key"
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current value will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Deletions of the key are not sent.
+func (s *KubernetesBackend) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	current, updates, err := s.watch(ctx, s.application(key))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	val, err := lookup(current, key)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	respChan := make(chan []byte)
+	go func() {
+		defer close(respChan)
+		defer cancel()
+		for {
+			select {
+			case respChan <- val:
+			case <-ctx.Done():
+				return
+			}
+			for {
+				pairs, ok := <-updates
+				if !ok {
+					return
+				}
+				v, err := lookup(pairs, key)
+				if err == nil && !bytes.Equal(v, val) {
+					val = v
+					break
+				}
+			}
+		}
+	}()
+	return respChan, nil
+}
+
+// WatchTree listens for changes on a "tree".
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current values will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Every change under the tree, including deletions, sends all its keypairs.
+func (s *KubernetesBackend) WatchTree(ctx context.Context, directory string) (<-chan []*backend.KVPair, error) {
+	directory = strings.Trim(directory, "/")
+	if directory != "" {
+		directory += "/"
+	}
+	current, updates, err := s.watch(ctx, s.application(directory))
+	if err != nil {
+		return nil, err
+	}
+
+	respCh := make(chan []*backend.KVPair)
+	go func() {
+		defer close(respCh)
+		pairs := filter(current, directory)
+		for {
+			select {
+			case respCh <- pairs:
+			case <-ctx.Done():
+				return
+			}
+			for {
+				p, ok := <-updates
+				if !ok {
+					return
+				}
+				if p = filter(p, directory); !equalPairs(p, pairs) {
+					pairs = p
+					break
+				}
+			}
+		}
+	}()
+	return respCh, nil
+}
+
+// equalPairs returns true if a and b hold the same keys and values
+func equalPairs(a, b []*backend.KVPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
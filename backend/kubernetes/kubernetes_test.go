@@ -0,0 +1,197 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAPIServer serves the ConfigMaps and Secrets of the namespace "prod"
+type fakeAPIServer struct {
+	sync.Mutex
+	*httptest.Server
+	rv       int
+	objects  map[string]map[string]interface{} // by kind/name
+	watchers map[string][]chan map[string]interface{}
+	history  map[string][]recorded // events by kind/name, replayed to new watches
+}
+
+// recorded is an event sent to the watches along with its resource version
+type recorded struct {
+	rv    int
+	event map[string]interface{}
+}
+
+func newFakeAPIServer(t *testing.T) *fakeAPIServer {
+	f := &fakeAPIServer{objects: make(map[string]map[string]interface{}), watchers: make(map[string][]chan map[string]interface{}), history: make(map[string][]recorded)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeAPIServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer t0ken" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	kind := strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/prod/")
+	name := strings.TrimPrefix(r.URL.Query().Get("fieldSelector"), "metadata.name=")
+	id := kind + "/" + name
+
+	f.Lock()
+	if r.URL.Query().Get("watch") != "true" {
+		items := []interface{}{}
+		if o, ok := f.objects[id]; ok {
+			items = append(items, o)
+		}
+		list := map[string]interface{}{"metadata": map[string]string{"resourceVersion": strconv.Itoa(f.rv)}, "items": items}
+		f.Unlock()
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	ch := make(chan map[string]interface{}, 10)
+	rv, _ := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+	for _, e := range f.history[id] {
+		if e.rv > rv {
+			ch <- e.event
+		}
+	}
+	f.watchers[id] = append(f.watchers[id], ch)
+	f.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-ch:
+			enc.Encode(e)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// set stores the object kind/name with data, deleting it if data is nil
+func (f *fakeAPIServer) set(kind, name string, data map[string]string) {
+	f.Lock()
+	defer f.Unlock()
+	id := kind + "/" + name
+	f.rv++
+	typ := "MODIFIED"
+	if _, ok := f.objects[id]; !ok {
+		typ = "ADDED"
+	}
+	o := map[string]interface{}{
+		"metadata": map[string]string{"name": name, "resourceVersion": strconv.Itoa(f.rv)},
+		"data":     data,
+	}
+	if data == nil {
+		typ = "DELETED"
+		delete(f.objects, id)
+	} else {
+		f.objects[id] = o
+	}
+	e := map[string]interface{}{"type": typ, "object": o}
+	f.history[id] = append(f.history[id], recorded{rv: f.rv, event: e})
+	for _, ch := range f.watchers[id] {
+		ch <- e
+	}
+}
+
+func newTestBackend(t *testing.T, f *fakeAPIServer) *KubernetesBackend {
+	s, err := NewWithOptions(f.URL, Options{Namespace: "prod", Secret: "test-secrets", Token: "t0ken"}, &backend.Config{Prefix: "settings", Bucket: "v1"})
+	require.NoError(t, err)
+	return s
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		f := newFakeAPIServer(t)
+		root := "settings/test/v1"
+		props := map[string]string{}
+		set := func(kvs map[string]string) {
+			for k, v := range kvs {
+				props[strings.Replace(strings.TrimPrefix(k, root+"/"), "/", ".", -1)] = v
+			}
+			// the server keeps the data it is given
+			data := make(map[string]string, len(props))
+			for k, v := range props {
+				data[k] = v
+			}
+			f.set("configmaps", "test", data)
+		}
+		return &backendtest.Store{Backend: newTestBackend(t, f), Root: root, Set: set}
+	})
+}
+
+func TestSecrets(t *testing.T) {
+	f := newFakeAPIServer(t)
+	f.set("configmaps", "test", map[string]string{"port": "8080", "store.host": "db.local", "store.password": "none"})
+	f.set("secrets", "test-secrets", map[string]string{"store.password": base64.StdEncoding.EncodeToString([]byte("s3cr3t"))})
+	s := newTestBackend(t, f)
+	ctx := context.Background()
+
+	// the secret takes precedence
+	v, err := s.Get(ctx, "/settings/test/v1/store/password")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", string(v))
+	_, err = s.Get(ctx, "/settings/other/v1/port")
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+
+	pairs, err := s.List(ctx, "/settings/test/v1/store")
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	assert.Equal(t, "settings/test/v1/store/host", pairs[0].Key)
+	assert.Equal(t, uint64(1), pairs[0].LastIndex)
+	assert.Equal(t, uint64(2), pairs[1].LastIndex)
+
+	s.opts.Token = "wrong"
+	_, err = s.Get(ctx, "/settings/test/v1/port")
+	assert.Error(t, err)
+	assert.NotEqual(t, backend.ErrKeyNotFound, err)
+}
+
+func TestWatchSecret(t *testing.T) {
+	f := newFakeAPIServer(t)
+	f.set("configmaps", "test", map[string]string{"db.host": "localhost"})
+	s := newTestBackend(t, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tree, err := s.WatchTree(ctx, "settings/test/v1/db")
+	require.NoError(t, err)
+	assert.Len(t, <-tree, 1)
+
+	// the secret did not exist when the watch started
+	f.set("secrets", "test-secrets", map[string]string{"db.password": base64.StdEncoding.EncodeToString([]byte("s3cr3t"))})
+	select {
+	case pairs := <-tree:
+		require.Len(t, pairs, 2)
+		assert.Equal(t, "settings/test/v1/db/password", pairs[1].Key)
+		assert.Equal(t, "s3cr3t", string(pairs[1].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+
+	f.set("configmaps", "test", nil)
+	select {
+	case pairs := <-tree:
+		assert.Len(t, pairs, 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
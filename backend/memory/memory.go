@@ -0,0 +1,375 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+)
+
+var (
+	storesMu sync.Mutex
+	stores   = make(map[string]*MemoryBackend)
+)
+
+func init() {
+	backend.Register("memory", func(endpoints []string, cnf *backend.Config) (backend.Backend, error) {
+		return New(endpoints, cnf)
+	})
+}
+
+// entry is a value stored in the backend along with the index of its last change
+type entry struct {
+	value []byte
+	index uint64
+}
+
+// MemoryBackend is a thread-safe in-memory Backend. Every change increments the index of the
+// store, which is used as the LastIndex of the changed key, as Consul does with ModifyIndex.
+//
+// It is intended for tests and for embedding getconf without an external store. Set and Seed
+// allow to mutate the keys, waking up the watches as a real store would.
+type MemoryBackend struct {
+	sync.Mutex
+	data    map[string]*entry
+	index   uint64
+	changed chan struct{} // closed and replaced on every change
+	prefix  string
+	bucket  string
+}
+
+// New returns the in-memory store named endpoints[0], creating it if needed, so every call with
+// the same name shares the same data. With no name, a new private store is returned.
+func New(endpoints []string, cnf *backend.Config) (*MemoryBackend, error) {
+	var s *MemoryBackend
+	if len(endpoints) == 0 || endpoints[0] == "" {
+		s = newStore()
+	} else {
+		storesMu.Lock()
+		var ok bool
+		if s, ok = stores[endpoints[0]]; !ok {
+			s = newStore()
+			stores[endpoints[0]] = s
+		}
+		storesMu.Unlock()
+	}
+	if cnf != nil {
+		s.Lock()
+		s.prefix = cnf.Prefix
+		s.bucket = cnf.Bucket
+		s.Unlock()
+	}
+	return s, nil
+}
+
+func newStore() *MemoryBackend {
+	return &MemoryBackend{data: make(map[string]*entry), changed: make(chan struct{})}
+}
+
+// GetPrefix return the defined prefix in the backend
+func (s *MemoryBackend) GetPrefix() string { return s.prefix }
+
+// GetBucket return the defined bucket in the backend
+func (s *MemoryBackend) GetBucket() string { return s.bucket }
+
+// SetWatchTimeDuration is a no-op as changes are notified as soon as they happen
+func (s *MemoryBackend) SetWatchTimeDuration(time time.Duration) {}
+
+// normalize removes the leading slash of key so the same layout is used as in the other backends
+func normalize(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+// Index returns the index of the last change in the store
+func (s *MemoryBackend) Index() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.index
+}
+
+// notify wakes up the watches. Must be called with the lock held.
+func (s *MemoryBackend) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Set sets key to value. It is a helper for tests equivalent to Put.
+func (s *MemoryBackend) Set(key, value string) {
+	s.Lock()
+	defer s.Unlock()
+	s.index++
+	s.data[normalize(key)] = &entry{value: []byte(value), index: s.index}
+	s.notify()
+}
+
+// Seed sets all the keys in kvs in a single change
+func (s *MemoryBackend) Seed(kvs map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+	s.index++
+	for k, v := range kvs {
+		s.data[normalize(k)] = &entry{value: []byte(v), index: s.index}
+	}
+	s.notify()
+}
+
+// Delete removes key. Deleting a key that does not exist is not an error.
+func (s *MemoryBackend) Delete(ctx context.Context, key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.data[normalize(key)]; !ok {
+		return nil
+	}
+	delete(s.data, normalize(key))
+	s.index++
+	s.notify()
+	return nil
+}
+
+// Reset removes every key from the store
+func (s *MemoryBackend) Reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.data = make(map[string]*entry)
+	s.index++
+	s.notify()
+}
+
+// Put sets the value of key, creating it if it does not exist. TTL is not supported.
+func (s *MemoryBackend) Put(ctx context.Context, key string, value []byte, opts *backend.WriteOptions) error {
+	if opts != nil && opts.TTL != 0 {
+		return backend.ErrNotSupported
+	}
+	s.Set(key, string(value))
+	return nil
+}
+
+// PutMany sets the values of all the keys of pairs in a single change
+func (s *MemoryBackend) PutMany(ctx context.Context, pairs map[string][]byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.index++
+	for k, v := range pairs {
+		s.data[normalize(k)] = &entry{value: append([]byte{}, v...), index: s.index}
+	}
+	s.notify()
+	return nil
+}
+
+// DeleteTree removes all the keys under directory
+func (s *MemoryBackend) DeleteTree(ctx context.Context, directory string) error {
+	directory = normalize(directory)
+	if directory != "" && directory[len(directory)-1] != '/' {
+		directory += "/"
+	}
+	s.Lock()
+	defer s.Unlock()
+	for k := range s.data {
+		if strings.HasPrefix(k, directory) {
+			delete(s.data, k)
+		}
+	}
+	s.index++
+	s.notify()
+	return nil
+}
+
+// AtomicPut sets the value of key only if its index is still the LastIndex of previous.
+// A nil previous creates the key only if it does not exist. TTL is not supported.
+func (s *MemoryBackend) AtomicPut(ctx context.Context, key string, value []byte, previous *backend.KVPair, opts *backend.WriteOptions) (bool, *backend.KVPair, error) {
+	if opts != nil && opts.TTL != 0 {
+		return false, nil, backend.ErrNotSupported
+	}
+	key = normalize(key)
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.data[key]
+	if previous == nil && ok {
+		return false, nil, backend.ErrKeyExists
+	}
+	if previous != nil && (!ok || e.index != previous.LastIndex) {
+		return false, nil, backend.ErrKeyModified
+	}
+	s.index++
+	s.data[key] = &entry{value: append([]byte{}, value...), index: s.index}
+	s.notify()
+	return true, &backend.KVPair{Key: key, Value: value, LastIndex: s.index}, nil
+}
+
+// AtomicDelete removes key only if its index is still the LastIndex of previous
+func (s *MemoryBackend) AtomicDelete(ctx context.Context, key string, previous *backend.KVPair) (bool, error) {
+	if previous == nil {
+		return false, backend.ErrPreviousNotSpecified
+	}
+	key = normalize(key)
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.data[key]
+	if !ok {
+		return false, backend.ErrKeyNotFound
+	}
+	if e.index != previous.LastIndex {
+		return false, backend.ErrKeyModified
+	}
+	delete(s.data, key)
+	s.index++
+	s.notify()
+	return true, nil
+}
+
+// Exists return true if key exists in backend and false otherwise
+func (s *MemoryBackend) Exists(ctx context.Context, key string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.data[normalize(key)]
+	return ok, nil
+}
+
+// Get a value given its key
+// It is safe to provide a timeout by using context.Timeout.
+func (s *MemoryBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.data[normalize(key)]
+	if !ok {
+		return nil, backend.ErrKeyNotFound
+	}
+	return append([]byte{}, e.value...), nil
+}
+
+// List will get all keypairs under a prefix
+// It is safe to provide a timeout by using context.Timeout.
+func (s *MemoryBackend) List(ctx context.Context, key string) ([]*backend.KVPair, error) {
+	s.Lock()
+	defer s.Unlock()
+	pairs := s.list(normalize(key))
+	if len(pairs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+// list returns the keypairs under prefix sorted by key. Must be called with the lock held.
+func (s *MemoryBackend) list(prefix string) []*backend.KVPair {
+	ret := []*backend.KVPair{}
+	for k, e := range s.data {
+		if strings.HasPrefix(k, prefix) {
+			ret = append(ret, &backend.KVPair{Key: k, Value: append([]byte{}, e.value...), LastIndex: e.index})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// treeIndex returns the highest index of the keys under prefix and their count. Must be
+// called with the lock held.
+func (s *MemoryBackend) treeIndex(prefix string) (uint64, int) {
+	var idx uint64
+	n := 0
+	for k, e := range s.data {
+		if strings.HasPrefix(k, prefix) {
+			n++
+			if e.index > idx {
+				idx = e.index
+			}
+		}
+	}
+	return idx, n
+}
+
+// Watch listens for changes on a "key"
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current value will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Deletions of the key are not sent.
+func (s *MemoryBackend) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	key = normalize(key)
+	s.Lock()
+	e, ok := s.data[key]
+	s.Unlock()
+	if !ok {
+		return nil, backend.ErrKeyNotFound
+	}
+
+	respChan := make(chan []byte)
+	go func() {
+		defer close(respChan)
+		val, index := e.value, e.index
+		for {
+			select {
+			case respChan <- append([]byte{}, val...):
+			case <-ctx.Done():
+				return
+			}
+			// Block until the key gets a new index
+			for {
+				s.Lock()
+				changed := s.changed
+				e, ok := s.data[key]
+				s.Unlock()
+				if ok && e.index != index {
+					val, index = e.value, e.index
+					break
+				}
+				select {
+				case <-changed:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return respChan, nil
+}
+
+// WatchTree listens for changes on a "tree".
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current values will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Every change under the tree, including deletions, sends all its keypairs.
+func (s *MemoryBackend) WatchTree(ctx context.Context, directory string) (<-chan []*backend.KVPair, error) {
+	directory = normalize(directory)
+	if directory != "" && directory[len(directory)-1] != '/' {
+		directory += "/"
+	}
+
+	respCh := make(chan []*backend.KVPair)
+	go func() {
+		defer close(respCh)
+		s.Lock()
+		pairs := s.list(directory)
+		index, count := s.treeIndex(directory)
+		s.Unlock()
+		for {
+			select {
+			case respCh <- pairs:
+			case <-ctx.Done():
+				return
+			}
+			// Block until the tree changes
+			for {
+				s.Lock()
+				changed := s.changed
+				idx, n := s.treeIndex(directory)
+				if idx != index || n != count {
+					pairs = s.list(directory)
+					index, count = idx, n
+					s.Unlock()
+					break
+				}
+				s.Unlock()
+				select {
+				case <-changed:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return respCh, nil
+}
@@ -0,0 +1,121 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		s, err := New(nil, nil)
+		require.NoError(t, err)
+		return &backendtest.Store{Backend: s}
+	})
+}
+
+func TestSeedIndex(t *testing.T) {
+	s, err := New(nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	s.Seed(map[string]string{"/app/v1/port": "80", "app/v1/store/host": "localhost"})
+	assert.Equal(t, uint64(1), s.Index())
+	require.NoError(t, s.Put(ctx, "app/v1/port", []byte("8080"), nil))
+	assert.Equal(t, uint64(2), s.Index())
+
+	pairs, err := s.List(ctx, "/app/v1")
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	assert.Equal(t, uint64(2), pairs[0].LastIndex)
+	assert.Equal(t, uint64(1), pairs[1].LastIndex)
+
+	assert.Equal(t, backend.ErrNotSupported, s.Put(ctx, "app/v1/port", []byte("8080"), &backend.WriteOptions{TTL: time.Second}))
+}
+
+func TestPutMany(t *testing.T) {
+	s, err := New(nil, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	var _ backend.Txn = s
+	require.NoError(t, s.PutMany(ctx, map[string][]byte{"/app/host": []byte("db.remote"), "app/port": []byte("6543")}))
+	assert.Equal(t, uint64(1), s.Index())
+	pairs, err := s.List(ctx, "app/")
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	assert.Equal(t, "app/host", pairs[0].Key)
+	assert.Equal(t, pairs[0].LastIndex, pairs[1].LastIndex)
+
+	// the store keeps its own copy of the values
+	buf := []byte("db.local")
+	require.NoError(t, s.PutMany(ctx, map[string][]byte{"app/host": buf}))
+	copy(buf, "xxxxxxxx")
+	v, err := s.Get(ctx, "app/host")
+	require.NoError(t, err)
+	assert.Equal(t, "db.local", string(v))
+}
+
+func TestNamedStores(t *testing.T) {
+	a, _ := New([]string{"shared"}, nil)
+	b, _ := New([]string{"shared"}, nil)
+	c, _ := New([]string{"other"}, nil)
+	ctx := context.Background()
+	a.Set("k", "v")
+	ok, _ := b.Exists(ctx, "k")
+	assert.True(t, ok)
+	ok, _ = c.Exists(ctx, "k")
+	assert.False(t, ok)
+}
+
+func TestWatchOtherKeys(t *testing.T) {
+	s, _ := New(nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Set("app/debug", "false")
+	ch, err := s.Watch(ctx, "app/debug")
+	require.NoError(t, err)
+	assert.Equal(t, "false", string(<-ch))
+
+	// changes in other keys do not wake the watch up
+	s.Set("app/other", "1")
+	s.Set("app/debug", "true")
+	select {
+	case v := <-ch:
+		assert.Equal(t, "true", string(v))
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestWatchTree(t *testing.T) {
+	s, _ := New(nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := s.WatchTree(ctx, "app/v1")
+	require.NoError(t, err)
+	assert.Len(t, <-ch, 0)
+
+	s.Set("app/v1/port", "80")
+	assert.Len(t, <-ch, 1)
+	s.Set("app/v2/port", "80")
+	s.Set("app/v1/host", "localhost")
+	pairs := <-ch
+	require.Len(t, pairs, 2)
+	assert.Equal(t, "app/v1/host", pairs[0].Key)
+
+	s.Delete(context.Background(), "app/v1/host")
+	select {
+	case pairs := <-ch:
+		assert.Len(t, pairs, 1)
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+	}
+}
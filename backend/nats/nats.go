@@ -0,0 +1,355 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var (
+	// ErrNoEndpoints is returned when no endpoint is provided to New
+	ErrNoEndpoints = errors.New("nats needs at least one endpoint")
+	// ErrNoBucket is returned when no bucket is provided in the backend.Config
+	ErrNoBucket = errors.New("nats needs a bucket")
+)
+
+func init() {
+	backend.Register("nats", func(endpoints []string, cnf *backend.Config) (backend.Backend, error) {
+		return New(endpoints, cnf)
+	})
+}
+
+// NATSBackend holds the configuration to use a NATS JetStream key-value bucket as Backend.
+// The revision of an entry is used as LastIndex.
+type NATSBackend struct {
+	sync.Mutex
+	conn   *natsgo.Conn
+	kv     jetstream.KeyValue
+	prefix string
+	bucket string
+}
+
+// New connects to the NATS servers in endpoints and opens the key-value bucket named as
+// cnf.Bucket, creating it if it does not exist. It returns the created Backend or an error
+func New(endpoints []string, cnf *backend.Config) (*NATSBackend, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if cnf == nil || cnf.Bucket == "" {
+		return nil, ErrNoBucket
+	}
+
+	s := &NATSBackend{prefix: cnf.Prefix, bucket: cnf.Bucket}
+	opts := []natsgo.Option{natsgo.Name("getconf")}
+	if cnf.TLS != nil {
+		opts = append(opts, natsgo.Secure(cnf.TLS))
+	} else if cnf.ClientTLS != nil {
+		tlsConfig, err := cnf.ClientTLS.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, natsgo.Secure(tlsConfig))
+	}
+	timeout := 5 * time.Second
+	if cnf.ConnectionTimeout != 0 {
+		timeout = cnf.ConnectionTimeout
+		opts = append(opts, natsgo.Timeout(timeout))
+	}
+
+	conn, err := natsgo.Connect(strings.Join(endpoints, ","), opts...)
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	kv, err := js.KeyValue(ctx, cnf.Bucket)
+	if err == jetstream.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: cnf.Bucket})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.conn = conn
+	s.kv = kv
+
+	return s, nil
+}
+
+// Close closes the connection to NATS
+func (s *NATSBackend) Close() error {
+	s.conn.Close()
+	return nil
+}
+
+// GetPrefix return the defined prefix in the backend
+func (s *NATSBackend) GetPrefix() string { return s.prefix }
+
+// GetBucket return the defined bucket in the backend
+func (s *NATSBackend) GetBucket() string { return s.bucket }
+
+// SetWatchTimeDuration is a no-op as JetStream watchers are pushed by the server
+func (s *NATSBackend) SetWatchTimeDuration(time time.Duration) {}
+
+// normalize removes the leading slash of key so the same layout is used as in the other backends
+func normalize(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+// Exists return true if key exists in backend and false otherwise
+func (s *NATSBackend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Get(ctx, key)
+	if err != nil {
+		if err == backend.ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Get a value given its key
+// It is safe to provide a timeout by using context.Timeout.
+func (s *NATSBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	entry, err := s.kv.Get(ctx, normalize(key))
+	if err == jetstream.ErrKeyNotFound || err == jetstream.ErrKeyDeleted {
+		return nil, backend.ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value(), nil
+}
+
+// Put sets the value of key, creating it if it does not exist.
+// TTLs are not supported, the bucket MaxAge applies to every key.
+func (s *NATSBackend) Put(ctx context.Context, key string, value []byte, opts *backend.WriteOptions) error {
+	if opts != nil && opts.TTL != 0 {
+		return backend.ErrNotSupported
+	}
+	_, err := s.kv.Put(ctx, normalize(key), value)
+	return err
+}
+
+// Delete places a delete marker for key. Deleting a key that does not exist is not an error.
+func (s *NATSBackend) Delete(ctx context.Context, key string) error {
+	return s.kv.Delete(ctx, normalize(key))
+}
+
+// DeleteTree places a delete marker for every key under directory
+func (s *NATSBackend) DeleteTree(ctx context.Context, directory string) error {
+	directory = normalize(directory)
+	if directory != "" && directory[len(directory)-1] != '/' {
+		directory += "/"
+	}
+	pairs, err := s.List(ctx, directory)
+	if err == backend.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if err := s.kv.Delete(ctx, p.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AtomicPut sets the value of key only if its revision is still the LastIndex of previous.
+// A nil previous creates the key only if it does not exist. TTLs are not supported.
+func (s *NATSBackend) AtomicPut(ctx context.Context, key string, value []byte, previous *backend.KVPair, opts *backend.WriteOptions) (bool, *backend.KVPair, error) {
+	if opts != nil && opts.TTL != 0 {
+		return false, nil, backend.ErrNotSupported
+	}
+	key = normalize(key)
+	if previous == nil {
+		rev, err := s.kv.Create(ctx, key, value)
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return false, nil, backend.ErrKeyExists
+		}
+		if err != nil {
+			return false, nil, err
+		}
+		return true, &backend.KVPair{Key: key, Value: value, LastIndex: rev}, nil
+	}
+	rev, err := s.kv.Update(ctx, key, value, previous.LastIndex)
+	if err != nil {
+		return false, nil, s.revisionError(ctx, key, err)
+	}
+	return true, &backend.KVPair{Key: key, Value: value, LastIndex: rev}, nil
+}
+
+// AtomicDelete places a delete marker for key only if its revision is still the LastIndex of
+// previous
+func (s *NATSBackend) AtomicDelete(ctx context.Context, key string, previous *backend.KVPair) (bool, error) {
+	if previous == nil {
+		return false, backend.ErrPreviousNotSpecified
+	}
+	key = normalize(key)
+	if err := s.kv.Delete(ctx, key, jetstream.LastRevision(previous.LastIndex)); err != nil {
+		return false, s.revisionError(ctx, key, err)
+	}
+	return true, nil
+}
+
+// revisionError maps a revision mismatch on key to ErrKeyNotFound if the key does not exist or
+// ErrKeyModified otherwise. Other errors are returned as they are.
+func (s *NATSBackend) revisionError(ctx context.Context, key string, err error) error {
+	if !errors.Is(err, jetstream.ErrKeyRevisionMismatch) {
+		return err
+	}
+	if _, err := s.Get(ctx, key); err != nil {
+		return err
+	}
+	return backend.ErrKeyModified
+}
+
+// List will get all keypairs under a prefix
+// It is safe to provide a timeout by using context.Timeout.
+func (s *NATSBackend) List(ctx context.Context, key string) ([]*backend.KVPair, error) {
+	w, err := s.kv.WatchAll(ctx, jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	prefix := normalize(key)
+	ret := []*backend.KVPair{}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case entry, ok := <-w.Updates():
+			if !ok {
+				return nil, errors.New("nats: watcher closed")
+			}
+			// nil marks the end of the current values
+			if entry == nil {
+				if len(ret) == 0 {
+					return nil, backend.ErrKeyNotFound
+				}
+				sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+				return ret, nil
+			}
+			if strings.HasPrefix(entry.Key(), prefix) {
+				ret = append(ret, &backend.KVPair{Key: entry.Key(), Value: entry.Value(), LastIndex: entry.Revision()})
+			}
+		}
+	}
+}
+
+// Watch listens for changes on a "key"
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current value will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Deletions of the key are not sent.
+func (s *NATSBackend) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	key = normalize(key)
+	if _, err := s.Get(ctx, key); err != nil {
+		return nil, err
+	}
+	w, err := s.kv.Watch(ctx, key, jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+
+	respChan := make(chan []byte)
+	go func() {
+		defer close(respChan)
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-w.Updates():
+				if !ok {
+					return
+				}
+				if entry == nil {
+					continue
+				}
+				select {
+				case respChan <- entry.Value():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return respChan, nil
+}
+
+// WatchTree listens for changes on a "tree".
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current values will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// Every change under the tree, including deletions, sends all its keypairs.
+func (s *NATSBackend) WatchTree(ctx context.Context, directory string) (<-chan []*backend.KVPair, error) {
+	directory = normalize(directory)
+	if directory != "" && directory[len(directory)-1] != '/' {
+		directory += "/"
+	}
+	w, err := s.kv.WatchAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	respCh := make(chan []*backend.KVPair)
+	go func() {
+		defer close(respCh)
+		defer w.Stop()
+		tree := make(map[string]*backend.KVPair)
+		initialized := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-w.Updates():
+				if !ok {
+					return
+				}
+				if entry == nil {
+					initialized = true
+				} else if strings.HasPrefix(entry.Key(), directory) {
+					if entry.Operation() == jetstream.KeyValuePut {
+						tree[entry.Key()] = &backend.KVPair{Key: entry.Key(), Value: entry.Value(), LastIndex: entry.Revision()}
+					} else {
+						delete(tree, entry.Key())
+					}
+				} else {
+					continue
+				}
+				if !initialized {
+					continue
+				}
+				pairs := make([]*backend.KVPair, 0, len(tree))
+				for _, p := range tree {
+					pairs = append(pairs, p)
+				}
+				sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+				select {
+				case respCh <- pairs:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return respCh, nil
+}
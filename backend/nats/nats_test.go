@@ -0,0 +1,74 @@
+package nats
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBackend starts an embedded NATS server with JetStream enabled
+func newTestBackend(t *testing.T) *NATSBackend {
+	dir, err := ioutil.TempDir("", "getconf-nats")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: dir, NoLog: true, NoSigs: true})
+	require.NoError(t, err)
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	require.True(t, srv.ReadyForConnections(5*time.Second))
+
+	s, err := New([]string{srv.ClientURL()}, &backend.Config{Bucket: "getconf", ConnectionTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(nil, &backend.Config{Bucket: "getconf"})
+	assert.Equal(t, ErrNoEndpoints, err)
+	_, err = New([]string{"nats://127.0.0.1:4222"}, &backend.Config{})
+	assert.Equal(t, ErrNoBucket, err)
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		return &backendtest.Store{Backend: newTestBackend(t)}
+	})
+}
+
+func TestWatchTreeDeleted(t *testing.T) {
+	s := newTestBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := s.WatchTree(ctx, "app/v1")
+	require.NoError(t, err)
+	assert.Len(t, <-ch, 0)
+
+	require.NoError(t, s.Put(ctx, "app/v1/host", []byte("localhost"), nil))
+	select {
+	case pairs := <-ch:
+		require.Len(t, pairs, 1)
+		assert.Equal(t, "app/v1/host", pairs[0].Key)
+		assert.Equal(t, "localhost", string(pairs[0].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+
+	require.NoError(t, s.kv.Delete(ctx, "app/v1/host"))
+	select {
+	case pairs := <-ch:
+		assert.Len(t, pairs, 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
@@ -0,0 +1,134 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBackend(t *testing.T, params string) (*RedisBackend, *miniredis.Miniredis) {
+	m := miniredis.RunT(t)
+	s, err := New([]string{"redis://" + m.Addr() + "/0" + params}, &backend.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	s.SetWatchTimeDuration(10 * time.Millisecond)
+	return s, m
+}
+
+func TestBackend(t *testing.T) {
+	for _, params := range []string{"", "?hash=settings"} {
+		t.Run(params, func(t *testing.T) {
+			backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+				s, _ := newTestBackend(t, params)
+				return &backendtest.Store{Backend: s, NoVersions: true}
+			})
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	for _, params := range []string{"", "?hash=settings"} {
+		s, m := newTestBackend(t, params)
+		ctx := context.Background()
+
+		err := s.Put(ctx, "app/token", []byte("abc"), &backend.WriteOptions{TTL: time.Minute})
+		if params != "" {
+			assert.Equal(t, backend.ErrNotSupported, err)
+			continue
+		}
+		require.NoError(t, err)
+		m.FastForward(2 * time.Minute)
+		ok, _ := s.Exists(ctx, "app/token")
+		assert.False(t, ok)
+	}
+}
+
+func TestWatchPolling(t *testing.T) {
+	s, m := newTestBackend(t, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the value is changed outside the backend
+	m.Set("app/debug", "false")
+	ch, err := s.Watch(ctx, "app/debug")
+	require.NoError(t, err)
+	assert.Equal(t, "false", string(<-ch))
+
+	m.Set("app/debug", "true")
+	select {
+	case v := <-ch:
+		assert.Equal(t, "true", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestWatchTreeNotifications(t *testing.T) {
+	s, m := newTestBackend(t, "?notify=true")
+	// polling would never fire during the test
+	s.SetWatchTimeDuration(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m.Set("app/v1/port", "80")
+	ch, err := s.WatchTree(ctx, "app/v1")
+	require.NoError(t, err)
+	pairs := <-ch
+	require.Len(t, pairs, 1)
+
+	// miniredis does not emit keyspace notifications, so they are published by hand
+	m.Set("app/v1/host", "localhost")
+	m.Publish("__keyspace@0__:app/v1/host", "set")
+	select {
+	case pairs = <-ch:
+		require.Len(t, pairs, 2)
+		assert.Equal(t, "app/v1/host", pairs[0].Key)
+		assert.Equal(t, "localhost", string(pairs[0].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestWatchTreeHash(t *testing.T) {
+	s, m := newTestBackend(t, "?hash=settings")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m.HSet("settings", "app/v1/port", "80")
+	ch, err := s.WatchTree(ctx, "/app/v1/")
+	require.NoError(t, err)
+	require.Len(t, <-ch, 1)
+
+	m.HSet("settings", "app/v1/port", "8080")
+	select {
+	case pairs := <-ch:
+		require.Len(t, pairs, 1)
+		assert.Equal(t, "8080", string(pairs[0].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestListSkipsNonStringKeys(t *testing.T) {
+	s, m := newTestBackend(t, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, s.Put(ctx, "settings/apps/test/v1/port", []byte("8000"), nil))
+	m.HSet("settings/apps/test/v1/meta", "owner", "ops")
+	m.Lpush("settings/apps/test/v1/history", "8080")
+
+	pairs, err := s.List(ctx, "settings/apps/test/v1")
+	require.NoError(t, err)
+	require.Len(t, pairs, 1)
+	assert.Equal(t, "settings/apps/test/v1/port", pairs[0].Key)
+
+	ch, err := s.WatchTree(ctx, "settings/apps/test/v1")
+	require.NoError(t, err)
+	assert.Len(t, <-ch, 1)
+}
@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownBackend = errors.New("unknown backend")
+)
+
+// Factory creates a Backend connected to urls with the configuration provided
+type Factory func(urls []string, cfg *Config) (Backend, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a Backend available by the provided name. Backend packages should call it
+// from their init function so importing them is enough to enable them.
+//
+// Names are case insensitive. If Register is called twice with the same name or if factory
+// is nil, it panics.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	name = strings.ToLower(name)
+	if factory == nil {
+		panic("backend: Register factory is nil for " + name)
+	}
+	if _, dup := factories[name]; dup {
+		panic("backend: Register called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// Open creates a Backend using the factory registered as name. If there is none,
+// ErrUnknownBackend is returned.
+func Open(name string, urls []string, cfg *Config) (Backend, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[strings.ToLower(name)]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownBackend
+	}
+	return factory(urls, cfg)
+}
+
+// Backends returns a sorted list of the names of the registered backends
+func Backends() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
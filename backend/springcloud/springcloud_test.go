@@ -0,0 +1,121 @@
+package springcloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer is a Spring Cloud Config Server serving the sources of the application "test"
+type fakeServer struct {
+	sync.Mutex
+	*httptest.Server
+	sources []map[string]interface{}
+	version string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	f := &fakeServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/test/prod,cloud/release(_)1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		env := map[string]interface{}{"name": "test", "label": "release/1.0", "version": f.version}
+		ps := []map[string]interface{}{}
+		for i, src := range f.sources {
+			ps = append(ps, map[string]interface{}{"name": "source" + string(rune('a'+i)), "source": src})
+		}
+		env["propertySources"] = ps
+		json.NewEncoder(w).Encode(env)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeServer) set(version string, sources ...map[string]interface{}) {
+	f.Lock()
+	defer f.Unlock()
+	f.version = version
+	f.sources = sources
+}
+
+func newTestBackend(t *testing.T, f *fakeServer) *SpringCloudBackend {
+	endpoint := "http://user:secret@" + f.Listener.Addr().String() + "?profile=prod,cloud"
+	s, err := New([]string{endpoint}, &backend.Config{Prefix: "/settings", Bucket: "release/1.0"})
+	require.NoError(t, err)
+	return s
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		f := newFakeServer(t)
+		s := newTestBackend(t, f)
+		s.SetWatchTimeDuration(10 * time.Millisecond)
+		root := "settings/test/release/1.0"
+		props := map[string]string{}
+		version := 0
+		set := func(kvs map[string]string) {
+			for k, v := range kvs {
+				props[strings.Replace(strings.TrimPrefix(k, root+"/"), "/", ".", -1)] = v
+			}
+			// the server keeps the source it is given
+			source := map[string]interface{}{}
+			for k, v := range props {
+				source[k] = v
+			}
+			version++
+			f.set(strconv.FormatInt(int64(version), 16), source)
+		}
+		return &backendtest.Store{Backend: s, Root: root, Set: set}
+	})
+}
+
+func TestSources(t *testing.T) {
+	f := newFakeServer(t)
+	f.set("0123456789abcdef0123456789abcdef01234567",
+		map[string]interface{}{"server.port": 9090, "debug": true},
+		map[string]interface{}{"server.port": 8080, "store.host": "db.local", "store.hosts": []string{"a", "b"}},
+	)
+	s := newTestBackend(t, f)
+	ctx := context.Background()
+
+	// the first source wins
+	v, err := s.Get(ctx, "/settings/test/release/1.0/server/port")
+	assert.NoError(t, err)
+	assert.Equal(t, "9090", string(v))
+	v, err = s.Get(ctx, "/settings/test/release/1.0/debug")
+	assert.NoError(t, err)
+	assert.Equal(t, "true", string(v))
+	v, err = s.Get(ctx, "/settings/test/release/1.0/store/hosts")
+	assert.NoError(t, err)
+	assert.Equal(t, `["a","b"]`, string(v))
+	_, err = s.Get(ctx, "/settings/test/release/1.0/store")
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+	_, err = s.Get(ctx, "/settings/other/release/1.0/debug")
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+
+	pairs, err := s.List(ctx, "/settings/test/release/1.0/store")
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	assert.Equal(t, "settings/test/release/1.0/store/host", pairs[0].Key)
+	assert.Equal(t, "db.local", string(pairs[0].Value))
+	assert.Equal(t, uint64(0x0123456789abcdef), pairs[0].LastIndex)
+}
@@ -0,0 +1,50 @@
+package sql
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresListener is a Listener using PostgreSQL LISTEN/NOTIFY through github.com/lib/pq.
+// It opens a connection of its own for every call to Changed, that is reconnected when lost.
+type PostgresListener struct {
+	dsn     string
+	channel string
+}
+
+// NewPostgresListener returns a Listener for the channel of the PostgreSQL database at dsn.
+// The channel must be notified by a trigger on the table, see Listener.
+func NewPostgresListener(dsn, channel string) *PostgresListener {
+	return &PostgresListener{dsn: dsn, channel: channel}
+}
+
+// Changed implements Listener. A value is also sent after a reconnection, since notifications
+// may have been lost while disconnected.
+func (l *PostgresListener) Changed(ctx context.Context) (<-chan struct{}, error) {
+	pl := pq.NewListener(l.dsn, time.Second, time.Minute, nil)
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		defer pl.Close()
+		// Listen blocks until connected. Meanwhile the table is still polled by the backend
+		go pl.Listen(l.channel)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-pl.Notify:
+				if !ok {
+					return
+				}
+			}
+			select {
+			case ch <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,137 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func newTestBackend(t *testing.T) *SQLBackend {
+	dir, err := ioutil.TempDir("", "getconf-sql")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := New([]string{"sqlite://" + filepath.Join(dir, "kv.db")}, &backend.Config{ConnectionTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		s := newTestBackend(t)
+		s.SetWatchTimeDuration(10 * time.Millisecond)
+		return &backendtest.Store{Backend: s}
+	})
+}
+
+func TestList(t *testing.T) {
+	s := newTestBackend(t)
+	ctx := context.Background()
+
+	require.NoError(t, s.Put(ctx, "/settings/apps/test/v1/port", []byte("8000"), nil))
+	require.NoError(t, s.Put(ctx, "/settings/apps/test/v1/port", []byte("8080"), nil))
+	require.NoError(t, s.Put(ctx, "/settings/apps/test/v1/store/host", []byte("db.local"), nil))
+	require.NoError(t, s.Put(ctx, "/settings/apps/test_v1/port", []byte("9000"), nil))
+
+	// the underscore is not a wildcard
+	pairs, err := s.List(ctx, "/settings/apps/test/")
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	assert.Equal(t, "settings/apps/test/v1/port", pairs[0].Key)
+	assert.Equal(t, uint64(2), pairs[0].LastIndex)
+	assert.Equal(t, uint64(1), pairs[1].LastIndex)
+}
+
+// chanListener is a Listener fired by hand
+type chanListener chan struct{}
+
+func (l chanListener) Changed(ctx context.Context) (<-chan struct{}, error) {
+	return l, nil
+}
+
+func TestWatchTreeListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getconf-sql")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite", filepath.Join(dir, "kv.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := make(chanListener)
+	s, err := NewWithDB(db, Options{Table: "config", Listener: l}, nil)
+	require.NoError(t, err)
+	// polling would never fire during the test
+	s.SetWatchTimeDuration(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := s.WatchTree(ctx, "app/v1")
+	require.NoError(t, err)
+	assert.Len(t, <-ch, 0)
+
+	require.NoError(t, s.Put(ctx, "app/v1/host", []byte("localhost"), nil))
+	l <- struct{}{}
+	select {
+	case pairs := <-ch:
+		require.Len(t, pairs, 1)
+		assert.Equal(t, "app/v1/host", pairs[0].Key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestWatchRecreated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getconf-sql")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite", filepath.Join(dir, "kv.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	l := make(chanListener)
+	s, err := NewWithDB(db, Options{Listener: l}, nil)
+	require.NoError(t, err)
+	s.SetWatchTimeDuration(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, s.Put(ctx, "app/host", []byte("old"), nil))
+	ch, err := s.Watch(ctx, "app/host")
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(<-ch))
+
+	// the recreated key has the same version than the deleted one
+	require.NoError(t, s.Delete(ctx, "app/host"))
+	require.NoError(t, s.Put(ctx, "app/host", []byte("new"), nil))
+	l <- struct{}{}
+	select {
+	case v := <-ch:
+		assert.Equal(t, "new", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
+
+func TestPostgresListenerClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// nothing listens there, the listener keeps reconnecting until canceled
+	ch, err := NewPostgresListener("postgres://localhost:1/config?sslmode=disable&connect_timeout=1", DefaultTable).Changed(ctx)
+	require.NoError(t, err)
+	cancel()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed")
+	}
+}
@@ -0,0 +1,776 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+)
+
+var (
+	// ErrMultipleEndpointsUnsupported is thrown when there are
+	// multiple endpoints specified for Vault
+	ErrMultipleEndpointsUnsupported = errors.New("vault does not support multiple endpoints")
+	// ErrNoEndpoints is returned when no endpoint is provided to New
+	ErrNoEndpoints = errors.New("vault needs an endpoint")
+	// ErrNoAuth is returned when no authentication method has been configured
+	ErrNoAuth = errors.New("vault needs a token, a token file or an AppRole")
+
+	defaultWatchTimeDuration = 15 * time.Second
+)
+
+func init() {
+	backend.Register("vault", func(endpoints []string, cnf *backend.Config) (backend.Backend, error) {
+		return New(endpoints, cnf)
+	})
+}
+
+// Options holds the Vault specific options
+type Options struct {
+	Mount     string // mount path of the KV v2 engine. Defaults to "secret"
+	Namespace string // Vault Enterprise namespace
+	Token     string // token authentication
+	TokenFile string // file holding the token, read again on every renewal (ex: Vault Agent sink)
+	RoleID    string // AppRole authentication
+	SecretID  string
+	// AppRoleMount is the mount path of the AppRole auth method. Defaults to "approle"
+	AppRoleMount string
+}
+
+// VaultBackend holds the configuration to connect to the KV v2 secrets engine of a Vault server.
+//
+// A secret holds several options: the last element of a key is the field of the secret and the
+// rest the secret path. The key "settings/apps/gcv2/v1/store/password" is the field "password" of
+// the secret "settings/apps/gcv2/v1/store". The version of the secret is used as LastIndex.
+type VaultBackend struct {
+	sync.Mutex
+	address   string
+	opts      Options
+	client    *http.Client
+	token     string
+	watchTime time.Duration
+	prefix    string
+	bucket    string
+	ctx       context.Context // canceled by Close to stop the token renewal
+	cancel    context.CancelFunc
+}
+
+// New create a Vault backend connection with the provided options. It returns the
+// created Backend or an error.
+//
+// The endpoint is the address of the server. The Options can be set as query params (mount,
+// namespace, token_file, role_id, secret_id and approle_mount) or from the environment variables
+// VAULT_TOKEN, VAULT_NAMESPACE, VAULT_ROLE_ID and VAULT_SECRET_ID:
+//
+//	https://vault.local:8200?mount=kv&role_id=...
+func New(endpoints []string, cnf *backend.Config) (*VaultBackend, error) {
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if len(endpoints) > 1 {
+		return nil, ErrMultipleEndpointsUnsupported
+	}
+	u, err := url.Parse(endpoints[0])
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	opts := Options{
+		Mount:        q.Get("mount"),
+		Namespace:    firstNonEmpty(q.Get("namespace"), os.Getenv("VAULT_NAMESPACE")),
+		Token:        os.Getenv("VAULT_TOKEN"),
+		TokenFile:    q.Get("token_file"),
+		RoleID:       firstNonEmpty(q.Get("role_id"), os.Getenv("VAULT_ROLE_ID")),
+		SecretID:     firstNonEmpty(q.Get("secret_id"), os.Getenv("VAULT_SECRET_ID")),
+		AppRoleMount: q.Get("approle_mount"),
+	}
+	u.RawQuery = ""
+	return NewWithOptions(u.String(), opts, cnf)
+}
+
+// NewWithOptions create a Vault backend connection to the server at address. It authenticates
+// and starts renewing the token in background. Close stops the renewal.
+func NewWithOptions(address string, opts Options, cnf *backend.Config) (*VaultBackend, error) {
+	if opts.Mount == "" {
+		opts.Mount = "secret"
+	}
+	if opts.AppRoleMount == "" {
+		opts.AppRoleMount = "approle"
+	}
+	if opts.Token == "" && opts.TokenFile == "" && opts.RoleID == "" {
+		return nil, ErrNoAuth
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	s := &VaultBackend{
+		address:   strings.TrimSuffix(address, "/"),
+		opts:      opts,
+		client:    &http.Client{},
+		watchTime: defaultWatchTimeDuration,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	// Set options
+	if cnf != nil {
+		s.prefix = cnf.Prefix
+		s.bucket = cnf.Bucket
+		transport := &http.Transport{}
+		if cnf.TLS != nil {
+			transport.TLSClientConfig = cnf.TLS
+			s.client.Transport = transport
+		} else if cnf.ClientTLS != nil {
+			tlsConfig, err := cnf.ClientTLS.TLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig = tlsConfig
+			s.client.Transport = transport
+		}
+		if cnf.ConnectionTimeout != 0 {
+			s.client.Timeout = cnf.ConnectionTimeout
+		}
+	}
+
+	// the login gets the request deadline, so a server that does not answer can not block New
+	ctx, cancel := backend.WithTimeout(context.Background(), cnf.Timeout())
+	defer cancel()
+	ttl, renewable, err := s.login(ctx)
+	if err != nil {
+		s.cancel()
+		return nil, err
+	}
+	go s.renew(ttl, renewable)
+
+	return s, nil
+}
+
+func firstNonEmpty(v ...string) string {
+	for _, s := range v {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// Close stops the token renewal, canceling the request in flight if any
+func (s *VaultBackend) Close() error {
+	s.cancel()
+	return nil
+}
+
+// GetPrefix return the defined prefix in the backend
+func (s *VaultBackend) GetPrefix() string { return s.prefix }
+
+// GetBucket return the defined bucket in the backend
+func (s *VaultBackend) GetBucket() string { return s.bucket }
+
+// SetWatchTimeDuration sets the interval used to poll the secret versions
+func (s *VaultBackend) SetWatchTimeDuration(time time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.watchTime = time
+}
+
+func (s *VaultBackend) watchTimeDuration() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.watchTime
+}
+
+func (s *VaultBackend) getToken() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.token
+}
+
+var (
+	// errNotFound is returned by do when the server answers with a 404
+	errNotFound = errors.New("not found")
+	// errCASMismatch is returned by do when a write fails because the check-and-set version
+	// is not the current one
+	errCASMismatch = errors.New("check-and-set mismatch")
+)
+
+// casRetries is the number of times the writes read and write again a secret that was
+// modified concurrently
+const casRetries = 5
+
+// do sends a request to the Vault API and decodes the response data in out, if not nil
+func (s *VaultBackend) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var r *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, s.address+"/v1/"+path, r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if t := s.getToken(); t != "" {
+		req.Header.Set("X-Vault-Token", t)
+	}
+	if s.opts.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.opts.Namespace)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if resp.StatusCode == http.StatusBadRequest && strings.Contains(strings.Join(e.Errors, "; "), "check-and-set") {
+			return errCASMismatch
+		}
+		return fmt.Errorf("vault: %s %s: %d %s", method, path, resp.StatusCode, strings.Join(e.Errors, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// authResponse is the response of the auth endpoints
+type authResponse struct {
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Data *struct {
+		TTL       int  `json:"ttl"`
+		Renewable bool `json:"renewable"`
+	} `json:"data"`
+}
+
+// login authenticates against Vault with the configured method and returns the token TTL and
+// whether it can be renewed.
+func (s *VaultBackend) login(ctx context.Context) (time.Duration, bool, error) {
+	switch {
+	case s.opts.RoleID != "":
+		var resp authResponse
+		body := map[string]string{"role_id": s.opts.RoleID, "secret_id": s.opts.SecretID}
+		if err := s.do(ctx, "POST", "auth/"+s.opts.AppRoleMount+"/login", body, &resp); err != nil {
+			return 0, false, err
+		}
+		if resp.Auth == nil {
+			return 0, false, errors.New("vault: approle login returned no token")
+		}
+		s.Lock()
+		s.token = resp.Auth.ClientToken
+		s.Unlock()
+		return time.Duration(resp.Auth.LeaseDuration) * time.Second, resp.Auth.Renewable, nil
+	case s.opts.TokenFile != "":
+		b, err := ioutil.ReadFile(s.opts.TokenFile)
+		if err != nil {
+			return 0, false, err
+		}
+		s.Lock()
+		s.token = strings.TrimSpace(string(b))
+		s.Unlock()
+	default:
+		s.Lock()
+		s.token = s.opts.Token
+		s.Unlock()
+	}
+
+	var resp authResponse
+	if err := s.do(ctx, "GET", "auth/token/lookup-self", nil, &resp); err != nil {
+		return 0, false, err
+	}
+	if resp.Data == nil {
+		return 0, false, nil
+	}
+	return time.Duration(resp.Data.TTL) * time.Second, resp.Data.Renewable, nil
+}
+
+// renew keeps the token alive renewing it when two thirds of its TTL have passed. If the
+// token can not be renewed, a new login is done. Tokens without TTL are not renewed.
+func (s *VaultBackend) renew(ttl time.Duration, renewable bool) {
+	for {
+		if ttl <= 0 {
+			return
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(ttl * 2 / 3):
+		}
+
+		ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+		var err error
+		if renewable && s.opts.TokenFile == "" {
+			var resp authResponse
+			if err = s.do(ctx, "POST", "auth/token/renew-self", nil, &resp); err == nil && resp.Auth != nil {
+				ttl, renewable = time.Duration(resp.Auth.LeaseDuration)*time.Second, resp.Auth.Renewable
+				cancel()
+				continue
+			}
+		}
+		ttl, renewable, err = s.login(ctx)
+		cancel()
+		if err != nil {
+			// retry soon, the current token may still be valid
+			ttl, renewable = 3*time.Second, false
+		}
+	}
+}
+
+// splitKey returns the secret path and field for key
+func splitKey(key string) (string, string) {
+	key = strings.Trim(key, "/")
+	if idx := strings.LastIndex(key, "/"); idx != -1 {
+		return key[:idx], key[idx+1:]
+	}
+	return "", key
+}
+
+// secret is a KV v2 secret
+type secret struct {
+	Data     map[string]interface{} `json:"data"`
+	Metadata struct {
+		Version uint64 `json:"version"`
+	} `json:"metadata"`
+}
+
+// readSecret reads the latest version of the secret at path
+func (s *VaultBackend) readSecret(ctx context.Context, path string) (*secret, error) {
+	sec, err := s.latest(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if sec.Data == nil {
+		// deleted or destroyed
+		return nil, backend.ErrKeyNotFound
+	}
+	return sec, nil
+}
+
+// latest reads the latest version of the secret at path, which has no Data if it was deleted
+func (s *VaultBackend) latest(ctx context.Context, path string) (*secret, error) {
+	var resp struct {
+		Data *secret `json:"data"`
+	}
+	if err := s.do(ctx, "GET", s.opts.Mount+"/data/"+path, nil, &resp); err != nil {
+		if err == errNotFound {
+			return nil, backend.ErrKeyNotFound
+		}
+		return nil, err
+	}
+	if resp.Data == nil {
+		return nil, backend.ErrKeyNotFound
+	}
+	return resp.Data, nil
+}
+
+// writeSecret writes data as a new version of the secret at path if its current version is
+// cas, 0 meaning that the secret does not exist. It returns the new version.
+func (s *VaultBackend) writeSecret(ctx context.Context, path string, data map[string]interface{}, cas uint64) (uint64, error) {
+	var resp struct {
+		Data struct {
+			Version uint64 `json:"version"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{"data": data, "options": map[string]interface{}{"cas": cas}}
+	if err := s.do(ctx, "POST", s.opts.Mount+"/data/"+path, body, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Data.Version, nil
+}
+
+// fields returns the data and version of the latest version of the secret at path. The data
+// of a secret that does not exist, or was deleted, is empty.
+func (s *VaultBackend) fields(ctx context.Context, path string) (map[string]interface{}, uint64, error) {
+	sec, err := s.latest(ctx, path)
+	if err == backend.ErrKeyNotFound {
+		// the version of a deleted secret is only in its metadata
+		var resp struct {
+			Data struct {
+				CurrentVersion uint64 `json:"current_version"`
+			} `json:"data"`
+		}
+		err = s.do(ctx, "GET", s.opts.Mount+"/metadata/"+path, nil, &resp)
+		if err != nil && err != errNotFound {
+			return nil, 0, err
+		}
+		return map[string]interface{}{}, resp.Data.CurrentVersion, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	data := make(map[string]interface{}, len(sec.Data))
+	for k, v := range sec.Data {
+		data[k] = v
+	}
+	return data, sec.Metadata.Version, nil
+}
+
+// update applies fn to the fields of the secret at path and writes them as a new version,
+// starting again if the secret is modified in between. fn returns false when there is nothing
+// to write.
+func (s *VaultBackend) update(ctx context.Context, path string, fn func(data map[string]interface{}) bool) error {
+	for i := 0; ; i++ {
+		data, version, err := s.fields(ctx, path)
+		if err != nil {
+			return err
+		}
+		if !fn(data) {
+			return nil
+		}
+		_, err = s.writeSecret(ctx, path, data, version)
+		if err != errCASMismatch || i == casRetries {
+			return err
+		}
+	}
+}
+
+// fieldValue returns the value of a secret field as bytes. Strings are returned as they are and
+// any other type in its JSON form.
+func fieldValue(v interface{}) []byte {
+	if str, ok := v.(string); ok {
+		return []byte(str)
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// Exists return true if key exists in backend and false otherwise
+func (s *VaultBackend) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Get(ctx, key)
+	if err != nil {
+		if err == backend.ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Get a value given its key
+// It is safe to provide a timeout by using context.Timeout.
+func (s *VaultBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	path, field := splitKey(key)
+	sec, err := s.readSecret(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := sec.Data[field]
+	if !ok {
+		return nil, backend.ErrKeyNotFound
+	}
+	return fieldValue(v), nil
+}
+
+// Put sets the value of key as a field of its secret, creating the secret if it does not
+// exist. The other fields are kept in the new version of the secret. TTLs are not supported.
+func (s *VaultBackend) Put(ctx context.Context, key string, value []byte, opts *backend.WriteOptions) error {
+	if opts != nil && opts.TTL != 0 {
+		return backend.ErrNotSupported
+	}
+	path, field := splitKey(key)
+	return s.update(ctx, path, func(data map[string]interface{}) bool {
+		data[field] = string(value)
+		return true
+	})
+}
+
+// Delete removes the field of key from its secret in a new version. A secret left without
+// fields keeps an empty version. Deleting a key that does not exist is not an error.
+func (s *VaultBackend) Delete(ctx context.Context, key string) error {
+	path, field := splitKey(key)
+	return s.update(ctx, path, func(data map[string]interface{}) bool {
+		if _, ok := data[field]; !ok {
+			return false
+		}
+		delete(data, field)
+		return true
+	})
+}
+
+// DeleteTree deletes the latest version of the secret at directory and of every secret below it.
+// The older versions are kept and can be undeleted.
+func (s *VaultBackend) DeleteTree(ctx context.Context, directory string) error {
+	pairs, err := s.list(ctx, strings.Trim(directory, "/"))
+	if err != nil {
+		return err
+	}
+	deleted := map[string]bool{}
+	for _, p := range pairs {
+		path, _ := splitKey(p.Key)
+		if deleted[path] {
+			continue
+		}
+		if err := s.do(ctx, "DELETE", s.opts.Mount+"/data/"+path, nil, nil); err != nil && err != errNotFound {
+			return err
+		}
+		deleted[path] = true
+	}
+	return nil
+}
+
+// AtomicPut sets the value of key only if the version of its secret is still the LastIndex of
+// previous. A nil previous creates the field only if it does not exist.
+//
+// As the version belongs to the secret, a change to any of its fields modifies the key.
+func (s *VaultBackend) AtomicPut(ctx context.Context, key string, value []byte, previous *backend.KVPair, opts *backend.WriteOptions) (bool, *backend.KVPair, error) {
+	if opts != nil && opts.TTL != 0 {
+		return false, nil, backend.ErrNotSupported
+	}
+	path, field := splitKey(key)
+	for i := 0; ; i++ {
+		data, version, err := s.fields(ctx, path)
+		if err != nil {
+			return false, nil, err
+		}
+		_, exists := data[field]
+		switch {
+		case previous == nil && exists:
+			return false, nil, backend.ErrKeyExists
+		case previous != nil && !exists:
+			return false, nil, backend.ErrKeyNotFound
+		case previous != nil && version != previous.LastIndex:
+			return false, nil, backend.ErrKeyModified
+		}
+		data[field] = string(value)
+		version, err = s.writeSecret(ctx, path, data, version)
+		if err == errCASMismatch && previous == nil && i < casRetries {
+			// another field changed, the key may still not exist
+			continue
+		}
+		if err == errCASMismatch {
+			return false, nil, backend.ErrKeyModified
+		}
+		if err != nil {
+			return false, nil, err
+		}
+		return true, &backend.KVPair{Key: strings.Trim(key, "/"), Value: value, LastIndex: version}, nil
+	}
+}
+
+// AtomicDelete removes the field of key only if the version of its secret is still the
+// LastIndex of previous
+func (s *VaultBackend) AtomicDelete(ctx context.Context, key string, previous *backend.KVPair) (bool, error) {
+	if previous == nil {
+		return false, backend.ErrPreviousNotSpecified
+	}
+	path, field := splitKey(key)
+	data, version, err := s.fields(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := data[field]; !ok {
+		return false, backend.ErrKeyNotFound
+	}
+	if version != previous.LastIndex {
+		return false, backend.ErrKeyModified
+	}
+	delete(data, field)
+	_, err = s.writeSecret(ctx, path, data, version)
+	if err == errCASMismatch {
+		return false, backend.ErrKeyModified
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// List will get all keypairs under a prefix
+// It is safe to provide a timeout by using context.Timeout.
+//
+// The fields of the secret at the prefix and of every secret below it are returned.
+func (s *VaultBackend) List(ctx context.Context, key string) ([]*backend.KVPair, error) {
+	pairs, err := s.list(ctx, strings.Trim(key, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, backend.ErrKeyNotFound
+	}
+	return pairs, nil
+}
+
+// list returns the fields of the secret at path and of the secrets below it, sorted by key
+func (s *VaultBackend) list(ctx context.Context, path string) ([]*backend.KVPair, error) {
+	ret := []*backend.KVPair{}
+	if path != "" {
+		sec, err := s.readSecret(ctx, path)
+		if err != nil && err != backend.ErrKeyNotFound {
+			return nil, err
+		}
+		if sec != nil {
+			for field, v := range sec.Data {
+				ret = append(ret, &backend.KVPair{Key: path + "/" + field, Value: fieldValue(v), LastIndex: sec.Metadata.Version})
+			}
+		}
+	}
+
+	var resp struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	dir := path
+	if dir != "" {
+		dir += "/"
+	}
+	err := s.do(ctx, "GET", s.opts.Mount+"/metadata/"+dir+"?list=true", nil, &resp)
+	if err != nil && err != errNotFound {
+		return nil, err
+	}
+	for _, k := range resp.Data.Keys {
+		child, err := s.list(ctx, dir+strings.TrimSuffix(k, "/"))
+		if err != nil {
+			return nil, err
+		}
+		// a name can be both a secret and a folder, so duplicates are removed
+		ret = append(ret, child...)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	uniq := ret[:0]
+	for i, p := range ret {
+		if i > 0 && p.Key == ret[i-1].Key {
+			continue
+		}
+		uniq = append(uniq, p)
+	}
+	return uniq, nil
+}
+
+// Watch listens for changes on a "key"
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current value will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// The version of the secret is polled every SetWatchTimeDuration.
+func (s *VaultBackend) Watch(ctx context.Context, key string) (<-chan []byte, error) {
+	path, field := splitKey(key)
+	sec, err := s.readSecret(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	current, ok := sec.Data[field]
+	if !ok {
+		return nil, backend.ErrKeyNotFound
+	}
+
+	respChan := make(chan []byte)
+	go func() {
+		defer close(respChan)
+		val := fieldValue(current)
+		version := sec.Metadata.Version
+		for {
+			select {
+			case respChan <- val:
+			case <-ctx.Done():
+				return
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(s.watchTimeDuration()):
+				}
+				sec, err := s.readSecret(ctx, path)
+				if err == backend.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					return
+				}
+				if sec.Metadata.Version == version {
+					continue
+				}
+				version = sec.Metadata.Version
+				if v, ok := sec.Data[field]; ok && !bytes.Equal(fieldValue(v), val) {
+					val = fieldValue(v)
+					break
+				}
+			}
+		}
+	}()
+	return respChan, nil
+}
+
+// WatchTree listens for changes on a "tree".
+// It returns a channel that will receive changes or pass on errors.
+// When created, the current values will be sent to the channel.
+// You can stop by using a context.Cancel when calling the method.
+//
+// The tree is polled every SetWatchTimeDuration and all its keypairs are sent when the version
+// of any secret changes.
+func (s *VaultBackend) WatchTree(ctx context.Context, directory string) (<-chan []*backend.KVPair, error) {
+	directory = strings.Trim(directory, "/")
+	current, err := s.list(ctx, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	respCh := make(chan []*backend.KVPair)
+	go func() {
+		defer close(respCh)
+		pairs := current
+		for {
+			select {
+			case respCh <- pairs:
+			case <-ctx.Done():
+				return
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(s.watchTimeDuration()):
+				}
+				p, err := s.list(ctx, directory)
+				if err != nil {
+					return
+				}
+				if !sameVersions(p, pairs) {
+					pairs = p
+					break
+				}
+			}
+		}
+	}()
+	return respCh, nil
+}
+
+// sameVersions returns true if a and b hold the same keys at the same versions
+func sameVersions(a, b []*backend.KVPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].LastIndex != b[i].LastIndex {
+			return false
+		}
+	}
+	return true
+}
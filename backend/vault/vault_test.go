@@ -0,0 +1,308 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/backendtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSecret struct {
+	data    map[string]interface{}
+	version uint64
+}
+
+// fakeVault is a minimal Vault HTTP API with a KV v2 engine at "secret", token and AppRole auth
+type fakeVault struct {
+	sync.Mutex
+	secrets  map[string]*fakeSecret
+	tokens   map[string]bool
+	ttl      int
+	renewals int
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	f := &fakeVault{secrets: map[string]*fakeSecret{}, tokens: map[string]bool{"root": true}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeVault) put(path string, data map[string]interface{}) {
+	f.Lock()
+	defer f.Unlock()
+	s, ok := f.secrets[path]
+	if !ok {
+		s = &fakeSecret{}
+		f.secrets[path] = s
+	}
+	s.data = data
+	s.version++
+}
+
+func (f *fakeVault) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path == "auth/approle/login" {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != "role" || body["secret_id"] != "s3cr3t" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.tokens["approle-token"] = true
+		f.reply(w, map[string]interface{}{"auth": map[string]interface{}{"client_token": "approle-token", "lease_duration": f.ttl, "renewable": true}})
+		return
+	}
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch {
+	case path == "auth/token/lookup-self":
+		f.reply(w, map[string]interface{}{"data": map[string]interface{}{"ttl": f.ttl, "renewable": f.ttl > 0}})
+	case path == "auth/token/renew-self":
+		f.renewals++
+		f.reply(w, map[string]interface{}{"auth": map[string]interface{}{"client_token": r.Header.Get("X-Vault-Token"), "lease_duration": f.ttl, "renewable": true}})
+	case strings.HasPrefix(path, "secret/data/") && r.Method == "POST":
+		var body struct {
+			Data    map[string]interface{}
+			Options struct{ CAS *uint64 }
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		p := strings.TrimPrefix(path, "secret/data/")
+		s, ok := f.secrets[p]
+		if !ok {
+			s = &fakeSecret{}
+		}
+		if body.Options.CAS != nil && *body.Options.CAS != s.version {
+			w.WriteHeader(http.StatusBadRequest)
+			f.reply(w, map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+			return
+		}
+		f.secrets[p] = s
+		s.data = body.Data
+		s.version++
+		f.reply(w, map[string]interface{}{"data": map[string]interface{}{"version": s.version}})
+	case strings.HasPrefix(path, "secret/data/") && r.Method == "DELETE":
+		if s, ok := f.secrets[strings.TrimPrefix(path, "secret/data/")]; ok {
+			s.data = nil
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "secret/data/"):
+		s, ok := f.secrets[strings.TrimPrefix(path, "secret/data/")]
+		if !ok || s.data == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.reply(w, map[string]interface{}{"data": map[string]interface{}{"data": s.data, "metadata": map[string]interface{}{"version": s.version}}})
+	case strings.HasPrefix(path, "secret/metadata/") && r.URL.Query().Get("list") == "":
+		s, ok := f.secrets[strings.TrimPrefix(path, "secret/metadata/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.reply(w, map[string]interface{}{"data": map[string]interface{}{"current_version": s.version}})
+	case strings.HasPrefix(path, "secret/metadata/") && r.URL.Query().Get("list") == "true":
+		dir := strings.TrimPrefix(path, "secret/metadata/")
+		seen := map[string]bool{}
+		for p := range f.secrets {
+			if !strings.HasPrefix(p, dir) {
+				continue
+			}
+			rest := strings.TrimPrefix(p, dir)
+			if idx := strings.Index(rest, "/"); idx != -1 {
+				rest = rest[:idx+1]
+			}
+			seen[rest] = true
+		}
+		if len(seen) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		keys := []string{}
+		for k := range seen {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		f.reply(w, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestTokenGetListExists(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.put("settings/apps/test/v1", map[string]interface{}{"port": 8000, "debug": "true"})
+	f.put("settings/apps/test/v1/store", map[string]interface{}{"password": "s3cr3t", "user": "adm"})
+
+	s, err := NewWithOptions(srv.URL, Options{Token: "root"}, &backend.Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	ctx := context.Background()
+
+	v, err := s.Get(ctx, "/settings/apps/test/v1/store/password")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", string(v))
+	v, err = s.Get(ctx, "/settings/apps/test/v1/port")
+	assert.NoError(t, err)
+	assert.Equal(t, "8000", string(v))
+
+	_, err = s.Get(ctx, "/settings/apps/test/v1/store/nope")
+	assert.Equal(t, backend.ErrKeyNotFound, err)
+	ok, err := s.Exists(ctx, "/settings/apps/test/v2/port")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	pairs, err := s.List(ctx, "/settings/apps/test/v1")
+	require.NoError(t, err)
+	keys := []string{}
+	for _, p := range pairs {
+		keys = append(keys, p.Key)
+	}
+	assert.Equal(t, []string{
+		"settings/apps/test/v1/debug",
+		"settings/apps/test/v1/port",
+		"settings/apps/test/v1/store/password",
+		"settings/apps/test/v1/store/user",
+	}, keys)
+	assert.Equal(t, uint64(1), pairs[0].LastIndex)
+}
+
+func TestAuth(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.put("app/v1", map[string]interface{}{"debug": "true"})
+
+	_, err := NewWithOptions(srv.URL, Options{}, nil)
+	assert.Equal(t, ErrNoAuth, err)
+
+	_, err = NewWithOptions(srv.URL, Options{Token: "bad"}, nil)
+	assert.Error(t, err)
+
+	tokenFile, err := ioutil.TempFile("", "vault-token")
+	require.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("root\n")
+	tokenFile.Close()
+	s, err := New([]string{srv.URL + "?token_file=" + tokenFile.Name()}, nil)
+	require.NoError(t, err)
+	v, err := s.Get(context.Background(), "app/v1/debug")
+	assert.NoError(t, err)
+	assert.Equal(t, "true", string(v))
+	s.Close()
+
+	// AppRole with a short TTL gets renewed
+	f.Lock()
+	f.ttl = 1
+	f.Unlock()
+	s, err = New([]string{srv.URL + "?role_id=role&secret_id=s3cr3t"}, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, "approle-token", s.getToken())
+	time.Sleep(1500 * time.Millisecond)
+	f.Lock()
+	renewals := f.renewals
+	f.Unlock()
+	assert.True(t, renewals > 0)
+
+	// Close stops the renewal
+	s.Close()
+	time.Sleep(1500 * time.Millisecond)
+	f.Lock()
+	assert.Equal(t, renewals, f.renewals)
+	f.Unlock()
+}
+
+func TestLoginTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	_, err := NewWithOptions(srv.URL, Options{Token: "root"}, &backend.Config{RequestTimeout: 100 * time.Millisecond})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) *backendtest.Store {
+		_, srv := newFakeVault(t)
+		s, err := NewWithOptions(srv.URL, Options{Token: "root"}, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		s.SetWatchTimeDuration(10 * time.Millisecond)
+		return &backendtest.Store{Backend: s}
+	})
+}
+
+func TestDeletedSecret(t *testing.T) {
+	_, srv := newFakeVault(t)
+	s, err := NewWithOptions(srv.URL, Options{Token: "root"}, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	ctx := context.Background()
+
+	require.NoError(t, s.Put(ctx, "app/v1/store/host", []byte("localhost"), nil))
+	require.NoError(t, s.DeleteTree(ctx, "app/v1"))
+
+	// a deleted secret is written again on top of its last version
+	ok, pair, err := s.AtomicPut(ctx, "app/v1/store/host", []byte("db.local"), nil, nil)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), pair.LastIndex)
+}
+
+func TestWatch(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.put("app/v1", map[string]interface{}{"debug": "false", "port": "80"})
+	s, err := NewWithOptions(srv.URL, Options{Token: "root"}, nil)
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetWatchTimeDuration(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := s.Watch(ctx, "app/v1/debug")
+	require.NoError(t, err)
+	assert.Equal(t, "false", string(<-ch))
+
+	tree, err := s.WatchTree(ctx, "app")
+	require.NoError(t, err)
+	assert.Len(t, <-tree, 2)
+
+	// a new version changing only another field is not sent by Watch
+	f.put("app/v1", map[string]interface{}{"debug": "false", "port": "8080"})
+	f.put("app/v1", map[string]interface{}{"debug": "true", "port": "8080"})
+	select {
+	case v := <-ch:
+		assert.Equal(t, "true", string(v))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+	select {
+	case pairs := <-tree:
+		require.Len(t, pairs, 2)
+		assert.Equal(t, "8080", string(pairs[1].Value))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change received")
+	}
+}
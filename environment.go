@@ -5,12 +5,21 @@ import (
 	"strings"
 )
 
-// loadFromEnv query the environment with the options defined and get its value if they exist
+// loadFromEnv query the environment with the options defined and get its value if they exist.
+//
+// If the option is not found by its name, its aliases and deprecated names are tried in order.
 func loadFromEnv() {
 	for _, o := range g2.options {
 		val := getEnv(g2.envPrefix, o.name, g2.keyDelim)
 		if val != "" {
 			g2.setOption(o.name, val, "env")
+			continue
+		}
+		for _, name := range o.altNames() {
+			if val := getEnv(g2.envPrefix, name, g2.keyDelim); val != "" {
+				g2.setOption(name, val, "env")
+				break
+			}
 		}
 	}
 }
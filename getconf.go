@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,6 +21,8 @@ var (
 	ErrUninitializedStruct = errors.New("uninitialized struct")
 	ErrKeyNotFound         = errors.New("key not found")
 	ErrValueNotString      = errors.New("value is not of type string")
+	ErrInvalidValue        = errors.New("value is not valid for the type of the option")
+	ErrDuplicateKey        = errors.New("option given more than once")
 )
 
 func init() {
@@ -35,24 +38,33 @@ func init() {
 type GetConf struct {
 	kvStore   backend.Backend
 	options   map[string]*Option
+	aliases   map[string]string // alias or deprecated name -> canonical option name
+	sections  map[string]*section
+	parsing   map[reflect.Type]bool // struct types being parsed, to stop on recursive types
+	secMu     sync.Mutex            // protects sections and the allocation of their pointers
 	setName   string
 	envPrefix string
 	keyDelim  string
-	kvPrefix  string // ej: "/settings/apps"
-	kvBucket  string // ej: "v1"
+	kvPrefix  string        // ej: "/settings/apps"
+	kvBucket  string        // ej: "v1"
+	kvTimeout time.Duration // deadline of the requests to kvStore made without a context
 }
 
 // Option holds the data needed to manage the variables in getconf
 // Option is the struct that holds information about the Option
 type Option struct {
-	name      string       // name as it appears on command line
-	oType     reflect.Kind // type of the option
-	value     interface{}  // value as set
-	defValue  string       // default value (as text); for usage message
-	usage     string       // help message
-	lastSetBy string       // last loader that has set the value
-	updatedAt time.Time    // updated timestamp
-	mu        sync.RWMutex // will keep concurrent acces safe. It is set per Option so a single operation do not block the full config set
+	name       string       // name as it appears on command line
+	oType      reflect.Kind // type of the option
+	value      interface{}  // value as set
+	raw        string       // value as set, before interpolation
+	defValue   string       // default value (as text); for usage message
+	usage      string       // help message
+	lastSetBy  string       // last loader that has set the value
+	updatedAt  time.Time    // updated timestamp
+	aliases    []string     // alternative names that resolve silently to this option
+	deprecated []string     // old names that resolve to this option emitting a DeprecationWarning
+	section    string       // innermost pointer to struct section holding the option, if any
+	mu         sync.RWMutex // will keep concurrent acces safe. It is set per Option so a single operation do not block the full config set
 }
 
 // LoaderOptions holds the options that getconf will use to manage
@@ -94,7 +106,10 @@ func (gc *GetConf) GetSetName() string {
 //   1. Environment variables
 //   2. command line flags
 //   3. remote server (consul)
-func Load(lo *LoaderOptions) {
+//
+// Once read, references to other options, environment variables or files in the values are
+// expanded (see Interpolate). An error is returned if the references can not be resolved.
+func Load(lo *LoaderOptions) error {
 	if lo.KeyDelim != "" {
 		g2.keyDelim = lo.KeyDelim
 	}
@@ -108,10 +123,14 @@ func Load(lo *LoaderOptions) {
 	}
 
 	g2.options = make(map[string]*Option)
+	g2.aliases = make(map[string]string)
+	g2.sections = make(map[string]*section)
+	g2.parsing = make(map[reflect.Type]bool)
 	// Parse client struct
 	g2.parseStruct(lo.ConfigStruct, "")
 	loadFromEnv()
 	g2.loadFromFlags()
+	return g2.interpolate()
 }
 
 // BindStruct will set the given struct fields to the values that exists in
@@ -123,20 +142,73 @@ func Load(lo *LoaderOptions) {
 // parseStruct parses the config struct and set the options from it, using prefix to
 // name nested variables.
 func (gc *GetConf) parseStruct(s interface{}, prefix string) {
-	x := indirect(s)
-	elem := reflect.ValueOf(x)
+	elem := reflect.ValueOf(s)
+	for elem.Kind() == reflect.Ptr && !elem.IsNil() {
+		elem = elem.Elem()
+	}
+	gc.parseValue(elem, prefix, parseCtx{base: elem})
+}
+
+// parseValue does the work for parseStruct over the reflect.Value of the struct. It is
+// used directly when recursing so unexported embedded structs can be walked too.
+//
+// Embedded (anonymous) structs are flattened into the parent namespace unless they are
+// given a name or a prefix in their tag. Named nested structs can be flattened with the
+// squash tag option.
+//
+// Pointers to struct and interfaces holding a struct are recursed into too. A pointer to
+// struct defines a section whose presence is tracked (see HasSection).
+//
+// A struct type that holds itself, like type Node struct{ Next *Node }, is only parsed once in
+// a path: its nested occurrences are sections without options.
+func (gc *GetConf) parseValue(elem reflect.Value, prefix string, ctx parseCtx) {
+	if gc.parsing[elem.Type()] {
+		return
+	}
+	gc.parsing[elem.Type()] = true
+	defer delete(gc.parsing, elem.Type())
+	callDefaulter(elem)
 	for i := 0; i < elem.NumField(); i++ {
 		fieldValue := elem.Field(i)
 		fieldType := elem.Type().Field(i)
+		if fieldValue.Kind() == reflect.Interface && !fieldValue.IsNil() && isStructType(fieldValue.Elem().Type()) {
+			opt := new(Option)
+			err := parseTags(fieldType, opt, prefix)
+			if err != nil && err.Error() == "untrack" {
+				continue
+			}
+			v := fieldValue.Elem()
+			for v.Kind() == reflect.Ptr && !v.IsNil() {
+				v = v.Elem()
+			}
+			g2.parseValue(v, nestedPrefix(fieldType, opt.name+g2.keyDelim, prefix, g2.keyDelim), parseCtx{section: ctx.section, base: v})
+			continue
+		}
+		if fieldValue.Kind() == reflect.Ptr && fieldValue.Type().Elem().Kind() == reflect.Struct && fieldValue.Type().Elem() != reflect.TypeOf(time.Time{}) {
+			opt := new(Option)
+			err := parseTags(fieldType, opt, prefix)
+			if err != nil && err.Error() == "untrack" {
+				continue
+			}
+			p := nestedPrefix(fieldType, opt.name+g2.keyDelim, prefix, g2.keyDelim)
+			name := g2.addSection(p, ctx, i)
+			v := reflect.New(fieldValue.Type().Elem()).Elem()
+			if !fieldValue.IsNil() {
+				v = fieldValue.Elem()
+			}
+			g2.parseValue(v, p, parseCtx{section: name})
+			continue
+		}
 		if fieldValue.Kind() == reflect.Struct {
-			switch fieldValue.Interface().(type) {
-			case time.Time:
+			if fieldValue.Type() == reflect.TypeOf(time.Time{}) {
 				opt := new(Option)
 				err := parseTags(fieldType, opt, prefix)
 				if err != nil && err.Error() == "untrack" {
 					continue
 				}
-				g2.options[opt.name] = opt
+				opt.section = ctx.section
+				setDefaultFromValue(opt, fieldValue)
+				g2.addOption(opt)
 				continue
 			}
 			opt := new(Option)
@@ -144,7 +216,7 @@ func (gc *GetConf) parseStruct(s interface{}, prefix string) {
 			if err != nil && err.Error() == "untrack" {
 				continue
 			}
-			g2.parseStruct(fieldValue.Interface(), opt.name+g2.keyDelim)
+			g2.parseValue(fieldValue, nestedPrefix(fieldType, opt.name+g2.keyDelim, prefix, g2.keyDelim), ctx.field(i))
 			continue
 		} else {
 			opt := new(Option)
@@ -152,11 +224,80 @@ func (gc *GetConf) parseStruct(s interface{}, prefix string) {
 			if err != nil && err.Error() == "untrack" {
 				continue
 			}
-			g2.options[opt.name] = opt
+			opt.section = ctx.section
+			setDefaultFromValue(opt, fieldValue)
+			g2.addOption(opt)
 		}
 	}
 }
 
+// Defaulter is implemented by config structs that compute their default values in Go. SetDefaults
+// is called by Load on the config struct and on every nested struct before reading their fields,
+// so the values it sets are taken as defaults.
+type Defaulter interface {
+	SetDefaults()
+}
+
+// callDefaulter calls SetDefaults on elem if it implements Defaulter.
+func callDefaulter(elem reflect.Value) {
+	if !elem.CanAddr() || !elem.Addr().CanInterface() {
+		return
+	}
+	if d, ok := elem.Addr().Interface().(Defaulter); ok {
+		d.SetDefaults()
+	}
+}
+
+// setDefaultFromValue sets the default of o from v, the value of its field in the config
+// struct, if it is not the zero value. It takes precedence over the default tag.
+func setDefaultFromValue(o *Option, v reflect.Value) {
+	if v.IsZero() {
+		return
+	}
+	var def string
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		def = strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		def = strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32:
+		def = strconv.FormatFloat(v.Float(), 'g', -1, 32)
+	case reflect.Float64:
+		def = strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case reflect.Bool:
+		def = strconv.FormatBool(v.Bool())
+	case reflect.String:
+		def = v.String()
+	case reflect.Struct:
+		if !v.CanInterface() {
+			return
+		}
+		t, ok := v.Interface().(time.Time)
+		if !ok {
+			return
+		}
+		def = t.Format(time.RFC3339Nano)
+	default:
+		return
+	}
+	o.defValue = def
+	o.value = getTypedValue(def, o.oType)
+	o.raw = def
+	o.updatedAt = time.Now().UTC()
+	o.lastSetBy = "default"
+}
+
+// addOption registers opt in the options set along with its alias and deprecated names.
+func (gc *GetConf) addOption(opt *Option) {
+	gc.options[opt.name] = opt
+	for _, a := range opt.aliases {
+		gc.aliases[a] = opt.name
+	}
+	for _, d := range opt.deprecated {
+		gc.aliases[d] = opt.name
+	}
+}
+
 // From html/template/content.go
 // Copyright 2011 The Go Authors. All rights reserved.
 // Returns de Value after dereferencing when needed
@@ -182,9 +323,10 @@ func (gc *GetConf) Set(key, value string) error {
 	if reflect.TypeOf(value).String() != "string" {
 		return ErrValueNotString
 	}
-	if _, ok := g2.options[key]; !ok {
+	if _, ok := g2.options[g2.resolveKey(key)]; !ok {
 		return ErrKeyNotFound
 	}
+	// setOption resolves key itself, warning when it is a deprecated name
 	g2.setOption(key, value, "user")
 	return nil
 }
@@ -192,16 +334,29 @@ func (gc *GetConf) Set(key, value string) error {
 // setOption set the option in gc.options that matches name with value.
 //
 // It also set the lastSetBy field to indicate who assigned the current value to the option.
+//
+// If name is an alias or a deprecated name, the canonical option is set instead and, for
+// deprecated names, a DeprecationWarning is emitted.
 func (gc *GetConf) setOption(name, value, setBy string) {
 	if _, ok := gc.options[name]; !ok {
-		return
+		canonical, ok := gc.aliases[name]
+		if !ok {
+			return
+		}
+		gc.warnIfDeprecated(name, setBy)
+		name = canonical
 	}
 	gc.options[name].mu.Lock()
 	defer gc.options[name].mu.Unlock()
 
 	gc.options[name].value = getTypedValue(value, gc.options[name].oType)
+	gc.options[name].raw = value
 	gc.options[name].updatedAt = time.Now().UTC()
 	gc.options[name].lastSetBy = setBy
+
+	if setBy != "default" && gc.options[name].section != "" {
+		gc.markSection(gc.options[name].section)
+	}
 }
 
 // String implements Stringer
@@ -220,11 +375,51 @@ func (gc *GetConf) loadFromFlags() {
 	flagConfigSet := flag.NewFlagSet(gc.setName, flag.ContinueOnError) //  flag.ExitOnError
 	for _, o := range g2.options {
 		flagConfigSet.Var(o, o.name, o.usage)
+		for _, a := range o.aliases {
+			flagConfigSet.Var(&aliasFlag{option: o}, a, "alias of "+o.name)
+		}
+		for _, d := range o.deprecated {
+			flagConfigSet.Var(&aliasFlag{option: o}, d, "deprecated: use "+o.name)
+		}
 	}
 	flagConfigSet.Parse(os.Args[1:])
-	flagConfigSet.Visit(g2.setConfigFromFlag)
+
+	// Flags given by their canonical name take precedence over aliases, whatever their order.
+	// Among several aliases of an option, the first in lexicographical order is used.
+	set := make(map[string]bool)
+	flagConfigSet.Visit(func(f *flag.Flag) {
+		if _, ok := g2.options[f.Name]; ok {
+			set[f.Name] = true
+			g2.setConfigFromFlag(f)
+		}
+	})
+	flagConfigSet.Visit(func(f *flag.Flag) {
+		name := g2.resolveKey(f.Name)
+		if f.Name == name || set[name] {
+			return
+		}
+		set[name] = true
+		g2.setConfigFromFlag(f)
+	})
 }
 
+// aliasFlag is the flag.Value of an alias or deprecated name of an option. It only records the
+// value given, which is applied after parsing unless the canonical name was given too.
+type aliasFlag struct {
+	option *Option
+	value  string
+}
+
+func (a *aliasFlag) String() string { return a.value }
+
+func (a *aliasFlag) Set(s string) error {
+	a.value = s
+	return nil
+}
+
+// IsBoolFlag returns true if the option is of type Bool, so the alias can be given without value
+func (a *aliasFlag) IsBoolFlag() bool { return a.option != nil && a.option.IsBoolFlag() }
+
 // setConfigFromFlag calls setOption to assign the value to an option readed from flags
 func (g2 *GetConf) setConfigFromFlag(f *flag.Flag) {
 	g2.setOption(f.Name, f.Value.String(), "flag")
@@ -1,11 +1,14 @@
 package getconf
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/jllopis/getconf/backend"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -112,3 +115,246 @@ func TestGetTypeValue(t *testing.T) {
 		t.Errorf("got: %T expected: string", result)
 	}
 }
+
+func TestAliasAndDeprecated(t *testing.T) {
+	type aliasConfig struct {
+		Store struct {
+			Password string `getconf:"password, deprecated: pass, info: store password"`
+			Host     string `getconf:"host, alias: hostname, default: localhost"`
+		}
+	}
+	var warnings []DeprecationWarning
+	SetDeprecationHandler(func(w DeprecationWarning) { warnings = append(warnings, w) })
+	defer SetDeprecationHandler(nil)
+
+	os.Setenv("GCV2_STORE__PASS", "secret")
+	defer os.Unsetenv("GCV2_STORE__PASS")
+	os.Setenv("GCV2_STORE__HOSTNAME", "db.local")
+	defer os.Unsetenv("GCV2_STORE__HOSTNAME")
+	Load(&LoaderOptions{
+		ConfigStruct: &aliasConfig{},
+		SetName:      "gc2test",
+		EnvPrefix:    "GCV2",
+	})
+
+	assert.Equal(t, "secret", GetString("store::password"))
+	assert.Equal(t, "secret", GetString("store::pass"))
+	assert.Equal(t, "db.local", GetString("store::host"))
+	assert.Equal(t, "db.local", GetString("store::hostname"))
+	if assert.Len(t, warnings, 1) {
+		assert.Equal(t, "store::pass", warnings[0].Name)
+		assert.Equal(t, "store::password", warnings[0].Replacement)
+		assert.Equal(t, "env", warnings[0].Source)
+	}
+
+	assert.NoError(t, Set("store::pass", "other"))
+	assert.Equal(t, "other", GetString("store::password"))
+	if assert.Len(t, warnings, 2) {
+		assert.Equal(t, "store::pass", warnings[1].Name)
+		assert.Equal(t, "user", warnings[1].Source)
+	}
+	assert.NoError(t, Set("store::hostname", "db.remote"))
+	assert.Len(t, warnings, 2)
+}
+
+func TestFlagAliasPrecedence(t *testing.T) {
+	type flagConfig struct {
+		Host     string `getconf:"host, alias: hostname, default: localhost"`
+		Password string `getconf:"password, deprecated: pass"`
+	}
+	SetDeprecationHandler(func(DeprecationWarning) {})
+	defer SetDeprecationHandler(nil)
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	for _, flags := range [][]string{
+		{"-hostname=alias", "-host=canonical", "-pass=old", "-password=new"},
+		{"-host=canonical", "-hostname=alias", "-password=new", "-pass=old"},
+	} {
+		os.Args = append([]string{"gc2test"}, flags...)
+		Load(&LoaderOptions{ConfigStruct: &flagConfig{}, SetName: "gc2test", EnvPrefix: "GCV2"})
+		assert.Equal(t, "canonical", GetString("host"), flags)
+		assert.Equal(t, "new", GetString("password"), flags)
+	}
+
+	// an alias is used when the canonical name is not given
+	os.Args = []string{"gc2test", "-hostname=alias", "-pass=old"}
+	Load(&LoaderOptions{ConfigStruct: &flagConfig{}, SetName: "gc2test", EnvPrefix: "GCV2"})
+	assert.Equal(t, "alias", GetString("host"))
+	assert.Equal(t, "old", GetString("password"))
+}
+
+type DBConfig struct {
+	Host string `getconf:"db-host, default: localhost"`
+	Port int    `getconf:"db-port, default: 5432"`
+}
+
+func TestEmbeddedStructs(t *testing.T) {
+	type embedConfig struct {
+		DBConfig
+		Replica DBConfig `getconf:"replica"`
+		Backup  DBConfig `getconf:"backup, prefix: bk"`
+		Cache   struct {
+			Size int `getconf:"cache-size, default: 64"`
+		} `getconf:"cache, squash"`
+	}
+	Load(&LoaderOptions{
+		ConfigStruct: &embedConfig{},
+		SetName:      "gc2test",
+		EnvPrefix:    "GCV2",
+	})
+
+	assert.Equal(t, "localhost", GetString("db-host"))
+	assert.Equal(t, 5432, GetInt("db-port"))
+	assert.Equal(t, "localhost", GetString("replica::db-host"))
+	assert.Equal(t, "localhost", GetString("bk::db-host"))
+	assert.Equal(t, 64, GetInt("cache-size"))
+	assert.Nil(t, Get("dbconfig::db-host"))
+}
+
+type TLSConfig struct {
+	Cert string `getconf:"cert"`
+	Key  string `getconf:"key"`
+	CA   *struct {
+		File string `getconf:"file"`
+	} `getconf:"ca"`
+}
+
+func TestPointerSections(t *testing.T) {
+	type ptrConfig struct {
+		TLS    *TLSConfig `getconf:"tls"`
+		Client *TLSConfig `getconf:"client"`
+		Store  interface{}
+	}
+	os.Setenv("GCV2_TLS__CA__FILE", "/etc/ca.pem")
+	defer os.Unsetenv("GCV2_TLS__CA__FILE")
+	os.Setenv("GCV2_STORE__DB_HOST", "db.local")
+	defer os.Unsetenv("GCV2_STORE__DB_HOST")
+
+	cfg := &ptrConfig{Store: &DBConfig{}}
+	Load(&LoaderOptions{
+		ConfigStruct: cfg,
+		SetName:      "gc2test",
+		EnvPrefix:    "GCV2",
+	})
+
+	assert.Equal(t, "/etc/ca.pem", GetString("tls::ca::file"))
+	assert.Equal(t, "db.local", GetString("store::db-host"))
+	assert.True(t, HasSection("tls"))
+	assert.True(t, HasSection("tls::ca"))
+	assert.False(t, HasSection("client"))
+	if assert.NotNil(t, cfg.TLS) {
+		assert.NotNil(t, cfg.TLS.CA)
+	}
+	assert.Nil(t, cfg.Client)
+
+	assert.NoError(t, Set("client::cert", "/etc/client.pem"))
+	assert.True(t, HasSection("client"))
+	assert.NotNil(t, cfg.Client)
+}
+
+type node struct {
+	Name string `getconf:"name, default: root"`
+	Next *node  `getconf:"next"`
+}
+
+func TestRecursiveSections(t *testing.T) {
+	type recursiveConfig struct {
+		List  *node `getconf:"list"`
+		Other *node `getconf:"other"`
+	}
+	assert.NoError(t, Load(&LoaderOptions{
+		ConfigStruct: &recursiveConfig{List: &node{Next: &node{}}},
+		SetName:      "gc2test",
+		EnvPrefix:    "GCV2",
+	}))
+	assert.Equal(t, "root", GetString("list::name"))
+	assert.Equal(t, "root", GetString("other::name"))
+	assert.Nil(t, Get("list::next::name"))
+}
+
+type defaultsConfig struct {
+	Workers int    `getconf:"workers, default: 1"`
+	Name    string `getconf:"name, default: tagname"`
+	Debug   bool   `getconf:"debug"`
+	Store   struct {
+		Host string `getconf:"host"`
+	}
+}
+
+func (c *defaultsConfig) SetDefaults() {
+	c.Workers = 8
+	c.Store.Host = "db.local"
+}
+
+func TestStructDefaults(t *testing.T) {
+	Load(&LoaderOptions{
+		ConfigStruct: &defaultsConfig{Name: "prepopulated"},
+		SetName:      "gc2test",
+		EnvPrefix:    "GCV2",
+	})
+
+	assert.Equal(t, 8, GetInt("workers"))
+	assert.Equal(t, "prepopulated", GetString("name"))
+	assert.Equal(t, "db.local", GetString("store::host"))
+	assert.Equal(t, "default", g2.options["workers"].lastSetBy)
+	assert.Equal(t, "8", g2.options["workers"].defValue)
+	assert.Nil(t, Get("debug"))
+}
+
+func TestInterpolation(t *testing.T) {
+	type interpConfig struct {
+		Store struct {
+			Host string `getconf:"host, default: db.local"`
+			Port int    `getconf:"port, default: 5432"`
+			Addr string `getconf:"addr, default: ${store::host}:${store::port}"`
+		}
+		Data   string `getconf:"data, default: ${env:GCV2_TEST_HOME}/data"`
+		Secret string `getconf:"secret"`
+		Port   int    `getconf:"port, default: ${store::port}"`
+	}
+	f, err := ioutil.TempFile("", "getconf")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("s3cr3t\n")
+	f.Close()
+
+	os.Setenv("GCV2_TEST_HOME", "/home/gc")
+	defer os.Unsetenv("GCV2_TEST_HOME")
+	os.Setenv("GCV2_SECRET", "${file:"+f.Name()+"}")
+	defer os.Unsetenv("GCV2_SECRET")
+
+	err = Load(&LoaderOptions{
+		ConfigStruct: &interpConfig{},
+		SetName:      "gc2test",
+		EnvPrefix:    "GCV2",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "db.local:5432", GetString("store::addr"))
+	assert.Equal(t, "/home/gc/data", GetString("data"))
+	assert.Equal(t, "s3cr3t", GetString("secret"))
+	assert.Equal(t, 5432, GetInt("port"))
+
+	assert.NoError(t, Set("store::host", "db.remote"))
+	assert.NoError(t, Interpolate())
+	assert.Equal(t, "db.remote:5432", GetString("store::addr"))
+}
+
+func TestInterpolationCycle(t *testing.T) {
+	type cycleConfig struct {
+		A string `getconf:"a, default: ${b}"`
+		B string `getconf:"b, default: x${a}"`
+	}
+	err := Load(&LoaderOptions{
+		ConfigStruct: &cycleConfig{},
+		SetName:      "gc2test",
+		EnvPrefix:    "GCV2",
+	})
+	assert.True(t, errors.Is(err, ErrInterpolationCycle), "got %v", err)
+}
+
+func TestEnableKVStoreUnknownBackend(t *testing.T) {
+	err := EnableKVStore(&KVOptions{Backend: "nonexistent"})
+	assert.Equal(t, backend.ErrUnknownBackend, err)
+	assert.Contains(t, backend.Backends(), "consul")
+}
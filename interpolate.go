@@ -0,0 +1,118 @@
+package getconf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var (
+	ErrInterpolationCycle = errors.New("interpolation cycle")
+	ErrUnterminatedRef    = errors.New("unterminated reference")
+)
+
+// hasRefs returns true if s holds any reference to be expanded.
+func hasRefs(s string) bool {
+	return strings.Contains(s, "${")
+}
+
+// interpolate expands the references found in the raw value of every option and sets the
+// resulting typed value. Options without references are left untouched.
+//
+// The references supported are:
+//
+//    * ${key}: the value of the option key (or one of its aliases)
+//    * ${env:VAR}: the value of the environment variable VAR
+//    * ${file:/path}: the content of the file at /path, without the trailing newline
+//
+// A literal "${" can be written as "$${".
+func (gc *GetConf) interpolate() error {
+	for name, o := range gc.options {
+		o.mu.RLock()
+		raw := o.raw
+		o.mu.RUnlock()
+		if !hasRefs(raw) {
+			continue
+		}
+		val, err := gc.expand(raw, []string{name})
+		if err != nil {
+			return fmt.Errorf("interpolating %s: %w", name, err)
+		}
+		o.mu.Lock()
+		o.value = getTypedValue(val, o.oType)
+		o.mu.Unlock()
+	}
+	return nil
+}
+
+// Interpolate expands again the references in the option values. It is called by Load and
+// EnableKVStore and when an option changes through a watch, so the options referencing it are
+// re-evaluated. It can be called after Set to do the same.
+func Interpolate() error { return g2.Interpolate() }
+func (gc *GetConf) Interpolate() error {
+	return gc.interpolate()
+}
+
+// expand replaces the references in s. stack holds the chain of options being expanded and is
+// used to detect cycles.
+func (gc *GetConf) expand(s string, stack []string) (string, error) {
+	var b strings.Builder
+	for {
+		idx := strings.Index(s, "${")
+		if idx == -1 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if idx > 0 && s[idx-1] == '$' {
+			b.WriteString(s[:idx-1] + "${")
+			s = s[idx+2:]
+			continue
+		}
+		end := strings.Index(s[idx:], "}")
+		if end == -1 {
+			return "", fmt.Errorf("%w: %s", ErrUnterminatedRef, s[idx:])
+		}
+		b.WriteString(s[:idx])
+		val, err := gc.resolveRef(s[idx+2:idx+end], stack)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(val)
+		s = s[idx+end+1:]
+	}
+}
+
+// resolveRef returns the value for the reference ref, the text between "${" and "}".
+func (gc *GetConf) resolveRef(ref string, stack []string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		return os.Getenv(strings.TrimPrefix(ref, "env:")), nil
+	case strings.HasPrefix(ref, "file:"):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	name := gc.resolveKey(ref)
+	o, ok := gc.options[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, ref)
+	}
+	for i, n := range stack {
+		if n == name {
+			return "", fmt.Errorf("%w: %s", ErrInterpolationCycle, strings.Join(append(stack[i:], name), " -> "))
+		}
+	}
+	o.mu.RLock()
+	raw := o.raw
+	o.mu.RUnlock()
+	if !hasRefs(raw) {
+		return raw, nil
+	}
+	return gc.expand(raw, append(stack, name))
+}
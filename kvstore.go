@@ -4,13 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/jllopis/getconf/backend"
-	"github.com/jllopis/getconf/backend/consul"
+	_ "github.com/jllopis/getconf/backend/consul" // consul is always available
 )
 
+// ErrKVStoreNotEnabled is returned by the functions that need a Backend when EnableKVStore has
+// not been called
+var ErrKVStoreNotEnabled = errors.New("kv store not enabled")
+
 // KVOptions holds the options that will be passed to the Backend
 // to connect to the remote server.
 //
@@ -31,57 +37,69 @@ func (gc *GetConf) GetKVStore() backend.Backend {
 
 // EnableKVStore sets the backend store as resource for options.
 // It will set the bucket with Prefix+setName+bucket
+//
+// opts.Backend is the name of a backend registered with backend.Register. Consul is always
+// available; other backends are enabled by importing their package.
 func EnableKVStore(opts *KVOptions) error { return g2.EnableKVStore(opts) }
 func (gc *GetConf) EnableKVStore(opts *KVOptions) error {
-	switch strings.ToLower(opts.Backend) {
-	case "consul":
-		// if opts.KVConfig.Prefix != "" && !strings.HasSuffix(opts.KVConfig.Prefix, "/") {
-		// 	opts.KVConfig.Prefix = opts.KVConfig.Prefix + "/"
-		// }
-		g2.kvPrefix = opts.KVConfig.Prefix
-		g2.kvBucket = opts.KVConfig.Bucket
-
-		// Initialize a new store with consul
-		kv, err := consul.New(opts.URLs, opts.KVConfig)
-		if err != nil {
-			return errors.New("cannot create store consul")
+	if opts.KVConfig == nil {
+		opts.KVConfig = &backend.Config{}
+	}
+	kv, err := backend.Open(opts.Backend, opts.URLs, opts.KVConfig)
+	if err != nil {
+		if err == backend.ErrUnknownBackend {
+			return err
 		}
-		gc.kvStore = kv
-	default:
-		return errors.New("unknown backend")
+		return fmt.Errorf("cannot create store %s: %v", strings.ToLower(opts.Backend), err)
 	}
+	g2.kvPrefix = opts.KVConfig.Prefix
+	g2.kvBucket = opts.KVConfig.Bucket
+	gc.kvTimeout = opts.KVConfig.Timeout()
+	// the previous Backend was created here too, so it is closed to stop its background work
+	if c, ok := gc.kvStore.(io.Closer); ok {
+		c.Close()
+	}
+	gc.kvStore = kv
 
 	// Read options from KV Store
 	loadFromKV(opts)
 
-	return nil
+	return gc.interpolate()
 }
 
 // loadFromKV query the Backend to get values for every defined option and sets
 // their values in getconf options.
 //
-// If a variable does not exist in the Backend, its value remains unchanged.
+// If a variable does not exist in the Backend, its aliases and deprecated names are tried
+// in order. If none is found, its value remains unchanged.
+//
+// Every request gets the RequestTimeout of the backend.Config as deadline.
 func loadFromKV(opts *KVOptions) {
 	for _, o := range g2.options {
-		name := strings.Replace(o.name, g2.keyDelim, "/", -1)
-		val := getKV(g2.kvStore, g2.kvPrefix+"/"+g2.setName+"/"+g2.kvBucket, name)
-		if val != "" {
-			g2.setOption(o.name, val, "kvstore")
+		for _, n := range append([]string{o.name}, o.altNames()...) {
+			name := strings.Replace(n, g2.keyDelim, "/", -1)
+			ctx, cancel := backend.WithTimeout(context.Background(), g2.kvTimeout)
+			val := getKV(ctx, g2.kvStore, g2.kvPrefix+"/"+g2.setName+"/"+g2.kvBucket, name)
+			cancel()
+			if val != "" {
+				g2.setOption(n, val, "kvstore")
+				break
+			}
 		}
 	}
 }
 
 // getKV get the value of key from the Backend. If the key is not found, the empty
 // value is returned.
-func getKV(kvs backend.Backend, path, key string) string {
+func getKV(ctx context.Context, kvs backend.Backend, path, key string) string {
 	prefix := path
 
 	if prefix[len(prefix)-1] != '/' {
 		prefix += "/"
 	}
 
-	if e, err := kvs.Exists(prefix + key); err == nil && e {
-		value, err := kvs.Get(context.TODO(), prefix+key)
+	if e, err := kvs.Exists(ctx, prefix+key); err == nil && e {
+		value, err := kvs.Get(ctx, prefix+key)
 		if err != nil {
 			return ""
 		}
@@ -93,16 +111,9 @@ func getKV(kvs backend.Backend, path, key string) string {
 // ListKV return an array of the variables found under the provided path in the Backend.
 func ListKV(path string) ([]*backend.KVPair, error) { return g2.ListKV(path) }
 func (gc *GetConf) ListKV(path string) ([]*backend.KVPair, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := backend.WithTimeout(context.Background(), gc.kvTimeout)
 	defer cancel()
 
-	go func() {
-		select {
-		case <-ctx.Done():
-			// fmt.Println(item + " -> " + ctx.Err().Error()) // prints "context deadline exceeded"
-		}
-	}()
-
 	e, err := gc.kvStore.List(ctx, path)
 	if err != nil {
 		return nil, err
@@ -122,7 +133,10 @@ func WatchWithFunc(ctx context.Context, key string, f func(newval []byte)) error
 }
 func (gc *GetConf) WatchWithFunc(ctx context.Context, name string, f func(newval []byte)) error {
 	key := getKVKey(name)
-	if ok, err := gc.kvStore.Exists(key); err != nil {
+	existsCtx, cancel := backend.WithTimeout(ctx, gc.kvTimeout)
+	ok, err := gc.kvStore.Exists(existsCtx, key)
+	cancel()
+	if err != nil {
 		// if ok, key exists and there was an error so we return
 		// if !ok, key does not exist so we can wait for its creation
 		if ok {
@@ -138,10 +152,16 @@ func (gc *GetConf) WatchWithFunc(ctx context.Context, name string, f func(newval
 		k := getGCKey(key)
 		for {
 			select {
-			case val := <-evt:
+			case val, ok := <-evt:
+				if !ok {
+					return
+				}
 				if val != nil {
 					fmt.Printf("changed value for key %s -> %s\nOrig key: %s\n", k, val, key)
 					gc.setOption(k, string(val), "kvstore")
+					if err := gc.interpolate(); err != nil {
+						fmt.Printf("cannot interpolate options after change in %s: %v\n", k, err)
+					}
 					f(val)
 				}
 			case <-ctx.Done():
@@ -189,12 +209,22 @@ func (gc *GetConf) WatchTreeWithFunc(ctx context.Context, dir string, f func(*ba
 		}
 		for {
 			select {
-			case pairList := <-evt:
+			case pairList, ok := <-evt:
+				if !ok {
+					return
+				}
 				for _, pair := range pairList {
 					if pair != nil {
 						split := strings.SplitAfter(pair.Key, dir)
-						key := split[len(split)-1]
+						key := strings.Replace(split[len(split)-1], "/", gc.keyDelim, -1)
 						gc.setOption(key, string(pair.Value), "kvstore")
+					}
+				}
+				if err := gc.interpolate(); err != nil {
+					fmt.Printf("cannot interpolate options after change in %s: %v\n", dir, err)
+				}
+				for _, pair := range pairList {
+					if pair != nil {
 						f(pair)
 					}
 				}
@@ -209,3 +239,238 @@ func SetWatchTimeDuration(time time.Duration) { g2.SetWatchTimeDuration(time) }
 func (gc *GetConf) SetWatchTimeDuration(time time.Duration) {
 	gc.kvStore.SetWatchTimeDuration(time)
 }
+
+// MigrateKVKeys copies the values stored under the alias and deprecated names of every option
+// to the key of its canonical name. Keys that already exist under the canonical name are not
+// overwritten. The old keys are left in place so instances not yet upgraded keep working.
+//
+// It returns the list of migrated keys in the form "old -> new". If dryRun is true, nothing is
+// written to the Backend. Read only Backends return backend.ErrNotSupported.
+func MigrateKVKeys(ctx context.Context, dryRun bool) ([]string, error) {
+	return g2.MigrateKVKeys(ctx, dryRun)
+}
+func (gc *GetConf) MigrateKVKeys(ctx context.Context, dryRun bool) ([]string, error) {
+	if gc.kvStore == nil {
+		return nil, ErrKVStoreNotEnabled
+	}
+	var migrated []string
+	for _, o := range gc.options {
+		newKey := getKVKey(o.name)
+		if e, err := gc.kvStore.Exists(ctx, newKey); err != nil {
+			return migrated, err
+		} else if e {
+			continue
+		}
+		for _, n := range o.altNames() {
+			oldKey := getKVKey(n)
+			val, err := gc.kvStore.Get(ctx, oldKey)
+			if err == backend.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return migrated, err
+			}
+			if !dryRun {
+				if err := gc.kvStore.Put(ctx, newKey, val, nil); err != nil {
+					return migrated, err
+				}
+			}
+			migrated = append(migrated, oldKey+" -> "+newKey)
+			break
+		}
+	}
+	return migrated, nil
+}
+
+// SeedMode selects how SeedKVStore writes the options. The modes can be combined with |.
+type SeedMode uint8
+
+// SeedSkipExisting only creates the keys that do not exist in the Backend. It is the default.
+const SeedSkipExisting SeedMode = 0
+
+const (
+	// SeedOverwrite writes every key, replacing the values already in the Backend
+	SeedOverwrite SeedMode = 1 << iota
+	// SeedDryRun reports the keys that would be written without writing them
+	SeedDryRun
+	// SeedCurrentValues writes the current value of the options instead of their default
+	SeedCurrentValues
+)
+
+// SeedKVStore writes the default of every option to its key under kvPrefix/setName/kvBucket in
+// the Backend, so a new deployment gets every key WatchWithFunc needs. With SeedCurrentValues
+// the current values are written instead, before interpolation so references are kept. The
+// options without default, or never set with SeedCurrentValues, are not written.
+//
+// Existing keys are skipped unless the mode includes SeedOverwrite. Keys are created with
+// AtomicPut so a key created concurrently is not overwritten either.
+//
+// It returns the keypairs written, sorted by key. With SeedDryRun nothing is written and the
+// keypairs that would be are returned.
+func SeedKVStore(ctx context.Context, mode SeedMode) ([]*backend.KVPair, error) {
+	return g2.SeedKVStore(ctx, mode)
+}
+func (gc *GetConf) SeedKVStore(ctx context.Context, mode SeedMode) ([]*backend.KVPair, error) {
+	if gc.kvStore == nil {
+		return nil, ErrKVStoreNotEnabled
+	}
+	names := make([]string, 0, len(gc.options))
+	for n := range gc.options {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	seeded := []*backend.KVPair{}
+	for _, n := range names {
+		o := gc.options[n]
+		o.mu.RLock()
+		val, set := o.defValue, o.defValue != ""
+		if mode&SeedCurrentValues != 0 {
+			val, set = o.raw, o.lastSetBy != ""
+		}
+		o.mu.RUnlock()
+		// without a default, or a value when seeding the current ones, there is nothing to publish
+		// and writing "" would blank the value in the Backend
+		if !set {
+			continue
+		}
+		pair := &backend.KVPair{Key: getKVKey(n), Value: []byte(val)}
+
+		switch {
+		case mode&SeedDryRun != 0 && mode&SeedOverwrite == 0:
+			if e, err := gc.kvStore.Exists(ctx, pair.Key); err != nil {
+				return seeded, err
+			} else if e {
+				continue
+			}
+		case mode&SeedDryRun != 0:
+		case mode&SeedOverwrite != 0:
+			if err := gc.kvStore.Put(ctx, pair.Key, pair.Value, nil); err != nil {
+				return seeded, err
+			}
+		default:
+			_, _, err := gc.kvStore.AtomicPut(ctx, pair.Key, pair.Value, nil, nil)
+			if err == backend.ErrKeyExists {
+				continue
+			}
+			if err != nil {
+				return seeded, err
+			}
+		}
+		seeded = append(seeded, pair)
+	}
+	return seeded, nil
+}
+
+// SetRemote writes value to the key of the option in the Backend and, once the write is
+// confirmed, sets it as the local value too. Other instances get it through their watches.
+//
+// The value must be valid for the type of the option unless it holds references to be
+// interpolated. The write is a compare and swap against the keypair read before, so a
+// concurrent change is not overwritten and backend.ErrKeyModified is returned instead. Backends
+// that can not compare versions are written with Put.
+func SetRemote(ctx context.Context, key, value string) error { return g2.SetRemote(ctx, key, value) }
+func (gc *GetConf) SetRemote(ctx context.Context, key, value string) error {
+	if gc.kvStore == nil {
+		return ErrKVStoreNotEnabled
+	}
+	name := gc.resolveKey(key)
+	o, ok := gc.options[name]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if !hasRefs(value) {
+		if err := checkTypedValue(value, o.oType); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	kvKey := getKVKey(name)
+	previous, err := gc.kvPair(ctx, kvKey)
+	if err != nil && err != backend.ErrKeyNotFound {
+		return err
+	}
+	_, _, err = gc.kvStore.AtomicPut(ctx, kvKey, []byte(value), previous, nil)
+	if err == backend.ErrNotSupported {
+		err = gc.kvStore.Put(ctx, kvKey, []byte(value), nil)
+	}
+	if err != nil {
+		return err
+	}
+	gc.setOption(key, value, "kvstore")
+	return gc.interpolate()
+}
+
+// ApplyChanges writes the values of changes, keyed by option, to the Backend in a single
+// transaction, so the watches of other instances never see only part of them. Once written, they
+// are set as the local values too.
+//
+// Every key must be an option and every value valid for its type unless it holds references to be
+// interpolated, otherwise nothing is written. An option given by more than one of its names, like
+// an alias and its canonical key, returns ErrDuplicateKey. The Backend must implement backend.Txn or
+// backend.ErrNotSupported is returned. Changes that do not fit in a transaction of the Backend
+// return backend.ErrTxnTooLarge and are neither written nor set.
+func ApplyChanges(ctx context.Context, changes map[string]string) error {
+	return g2.ApplyChanges(ctx, changes)
+}
+func (gc *GetConf) ApplyChanges(ctx context.Context, changes map[string]string) error {
+	if gc.kvStore == nil {
+		return ErrKVStoreNotEnabled
+	}
+	txn, ok := gc.kvStore.(backend.Txn)
+	if !ok {
+		return backend.ErrNotSupported
+	}
+
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make(map[string]string, len(changes))
+	pairs := make(map[string][]byte, len(changes))
+	given := make(map[string]string, len(changes))
+	for _, key := range keys {
+		name := gc.resolveKey(key)
+		o, ok := gc.options[name]
+		if !ok {
+			return fmt.Errorf("%s: %w", key, ErrKeyNotFound)
+		}
+		if prev, ok := given[name]; ok {
+			return fmt.Errorf("%s and %s: %w", prev, key, ErrDuplicateKey)
+		}
+		given[name] = key
+		value := changes[key]
+		if !hasRefs(value) {
+			if err := checkTypedValue(value, o.oType); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		values[key] = value
+		pairs[getKVKey(name)] = []byte(value)
+	}
+
+	if err := txn.PutMany(ctx, pairs); err != nil {
+		return err
+	}
+	for key, value := range values {
+		gc.setOption(key, value, "kvstore")
+	}
+	return gc.interpolate()
+}
+
+// kvPair returns the keypair stored at key in the Backend. Its parent directory is listed, as
+// not every Backend lists a key by its own name.
+func (gc *GetConf) kvPair(ctx context.Context, key string) (*backend.KVPair, error) {
+	key = strings.TrimPrefix(key, "/")
+	pairs, err := gc.kvStore.List(ctx, key[:strings.LastIndex(key, "/")+1])
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pairs {
+		if strings.TrimPrefix(p.Key, "/") == key {
+			return p, nil
+		}
+	}
+	return nil, backend.ErrKeyNotFound
+}
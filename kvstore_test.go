@@ -0,0 +1,265 @@
+package getconf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jllopis/getconf/backend"
+	"github.com/jllopis/getconf/backend/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type kvConfig struct {
+	Debug bool `getconf:"debug, default: false"`
+	Store struct {
+		Host     string `getconf:"host, default: localhost"`
+		Port     int    `getconf:"port, default: 5432"`
+		Password string `getconf:"password, deprecated: pass"`
+	}
+	Addr string `getconf:"addr, default: ${store::host}:${store::port}"`
+}
+
+// closed counts the calls to Close of the closerBackends
+var closed int
+
+// closerBackend is a memory backend that counts the calls to Close
+type closerBackend struct {
+	*memory.MemoryBackend
+}
+
+func (b closerBackend) Close() error {
+	closed++
+	return nil
+}
+
+func init() {
+	backend.Register("closer", func(urls []string, cfg *backend.Config) (backend.Backend, error) {
+		s, err := memory.New(urls, cfg)
+		return closerBackend{s}, err
+	})
+}
+
+func TestEnableKVStoreClosesPrevious(t *testing.T) {
+	loadKV(t, nil)
+	closed = 0
+	opts := &KVOptions{Backend: "closer", URLs: []string{t.Name()}, KVConfig: &backend.Config{Prefix: "settings/apps"}}
+	require.NoError(t, EnableKVStore(opts))
+	assert.Equal(t, 0, closed)
+	require.NoError(t, EnableKVStore(opts))
+	assert.Equal(t, 1, closed)
+}
+
+// loadKV loads kvConfig and enables a new memory backend seeded with kvs
+func loadKV(t *testing.T, kvs map[string]string) *memory.MemoryBackend {
+	require.NoError(t, Load(&LoaderOptions{
+		ConfigStruct: &kvConfig{},
+		SetName:      "gc2test",
+		EnvPrefix:    "GCV2",
+	}))
+	store, _ := memory.New([]string{t.Name()}, nil)
+	store.Reset()
+	store.Seed(kvs)
+	require.NoError(t, EnableKVStore(&KVOptions{
+		Backend: "memory",
+		URLs:    []string{t.Name()},
+		KVConfig: &backend.Config{
+			Prefix: "/settings/apps",
+			Bucket: "v1",
+		},
+	}))
+	return store
+}
+
+func TestLoadFromKV(t *testing.T) {
+	SetDeprecationHandler(func(DeprecationWarning) {})
+	defer SetDeprecationHandler(nil)
+	loadKV(t, map[string]string{
+		"settings/apps/gc2test/v1/debug":      "true",
+		"settings/apps/gc2test/v1/store/host": "db.remote",
+		"settings/apps/gc2test/v1/store/pass": "s3cr3t",
+	})
+
+	assert.True(t, GetBool("debug"))
+	assert.Equal(t, "db.remote", GetString("store::host"))
+	assert.Equal(t, "kvstore", g2.options["store::host"].lastSetBy)
+	assert.Equal(t, "s3cr3t", GetString("store::password"))
+	assert.Equal(t, "db.remote:5432", GetString("addr"))
+
+	pairs, err := ListKV("settings/apps/gc2test/v1/store")
+	require.NoError(t, err)
+	assert.Len(t, pairs, 2)
+}
+
+func TestWatchWithFunc(t *testing.T) {
+	store := loadKV(t, map[string]string{"settings/apps/gc2test/v1/store/port": "5432"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := make(chan string, 2)
+	require.NoError(t, WatchWithFunc(ctx, "store::port", func(v []byte) { got <- string(v) }))
+	assert.Equal(t, "5432", <-got)
+
+	store.Set("settings/apps/gc2test/v1/store/port", "6543")
+	select {
+	case v := <-got:
+		assert.Equal(t, "6543", v)
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+	}
+	assert.Equal(t, 6543, GetInt("store::port"))
+	assert.Equal(t, "localhost:6543", GetString("addr"))
+}
+
+func TestWatchTreeWithFunc(t *testing.T) {
+	store := loadKV(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := make(chan *backend.KVPair, 10)
+	require.NoError(t, WatchTreeWithFunc(ctx, "/settings/apps/gc2test/v1", func(kv *backend.KVPair) { got <- kv }))
+
+	store.Set("settings/apps/gc2test/v1/store/host", "db.watched")
+	select {
+	case kv := <-got:
+		assert.Equal(t, "settings/apps/gc2test/v1/store/host", kv.Key)
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+	}
+	assert.Equal(t, "db.watched", GetString("store::host"))
+	assert.Equal(t, "db.watched:5432", GetString("addr"))
+}
+
+func TestMigrateKVKeys(t *testing.T) {
+	store := loadKV(t, map[string]string{"settings/apps/gc2test/v1/store/pass": "s3cr3t"})
+	ctx := context.Background()
+
+	migrated, err := MigrateKVKeys(ctx, true)
+	require.NoError(t, err)
+	assert.Len(t, migrated, 1)
+	ok, _ := store.Exists(ctx, "settings/apps/gc2test/v1/store/password")
+	assert.False(t, ok)
+
+	migrated, err = MigrateKVKeys(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/settings/apps/gc2test/v1/store/pass -> /settings/apps/gc2test/v1/store/password"}, migrated)
+	v, err := store.Get(ctx, "settings/apps/gc2test/v1/store/password")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", string(v))
+}
+
+func TestSetRemote(t *testing.T) {
+	store := loadKV(t, map[string]string{"settings/apps/gc2test/v1/store/port": "5432"})
+	ctx := context.Background()
+
+	require.NoError(t, SetRemote(ctx, "store::port", "6543"))
+	v, err := store.Get(ctx, "settings/apps/gc2test/v1/store/port")
+	assert.NoError(t, err)
+	assert.Equal(t, "6543", string(v))
+	assert.Equal(t, 6543, GetInt("store::port"))
+	assert.Equal(t, "localhost:6543", GetString("addr"))
+
+	// keys not in the store are created
+	require.NoError(t, SetRemote(ctx, "debug", "true"))
+	assert.True(t, GetBool("debug"))
+	ok, _ := store.Exists(ctx, "settings/apps/gc2test/v1/debug")
+	assert.True(t, ok)
+
+	// nothing is written when the value is not valid
+	assert.ErrorIs(t, SetRemote(ctx, "store::port", "high"), ErrInvalidValue)
+	v, _ = store.Get(ctx, "settings/apps/gc2test/v1/store/port")
+	assert.Equal(t, "6543", string(v))
+	assert.Equal(t, 6543, GetInt("store::port"))
+	assert.Equal(t, ErrKeyNotFound, SetRemote(ctx, "nope", "1"))
+}
+
+func TestSeedModes(t *testing.T) {
+	assert.Equal(t, []SeedMode{0, 1, 2, 4}, []SeedMode{SeedSkipExisting, SeedOverwrite, SeedDryRun, SeedCurrentValues})
+}
+
+func TestSeedKVStore(t *testing.T) {
+	store := loadKV(t, map[string]string{
+		"settings/apps/gc2test/v1/store/port":     "6543",
+		"settings/apps/gc2test/v1/store/password": "s3cr3t",
+	})
+	ctx := context.Background()
+	keys := func(pairs []*backend.KVPair) []string {
+		ret := []string{}
+		for _, p := range pairs {
+			ret = append(ret, p.Key)
+		}
+		return ret
+	}
+
+	seeded, err := SeedKVStore(ctx, SeedSkipExisting|SeedDryRun)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"/settings/apps/gc2test/v1/addr",
+		"/settings/apps/gc2test/v1/debug",
+		"/settings/apps/gc2test/v1/store/host",
+	}, keys(seeded))
+	ok, _ := store.Exists(ctx, "settings/apps/gc2test/v1/debug")
+	assert.False(t, ok)
+
+	seeded, err = SeedKVStore(ctx, SeedSkipExisting)
+	require.NoError(t, err)
+	assert.Len(t, seeded, 3)
+	v, err := store.Get(ctx, "settings/apps/gc2test/v1/addr")
+	assert.NoError(t, err)
+	assert.Equal(t, "${store::host}:${store::port}", string(v))
+	v, _ = store.Get(ctx, "settings/apps/gc2test/v1/store/port")
+	assert.Equal(t, "6543", string(v))
+
+	seeded, err = SeedKVStore(ctx, SeedSkipExisting)
+	require.NoError(t, err)
+	assert.Len(t, seeded, 0)
+
+	// the password has no default, its remote value is kept
+	seeded, err = SeedKVStore(ctx, SeedOverwrite)
+	require.NoError(t, err)
+	assert.Len(t, seeded, 4)
+	v, _ = store.Get(ctx, "settings/apps/gc2test/v1/store/port")
+	assert.Equal(t, "5432", string(v))
+	v, _ = store.Get(ctx, "settings/apps/gc2test/v1/store/password")
+	assert.Equal(t, "s3cr3t", string(v))
+
+	// the value loaded from the store is the current one
+	_, err = SeedKVStore(ctx, SeedOverwrite|SeedCurrentValues)
+	require.NoError(t, err)
+	v, _ = store.Get(ctx, "settings/apps/gc2test/v1/store/port")
+	assert.Equal(t, "6543", string(v))
+
+	// an option never set is not written
+	store = loadKV(t, map[string]string{"settings/apps/gc2test/v1/store/port": "6543"})
+	seeded, err = SeedKVStore(ctx, SeedOverwrite|SeedCurrentValues)
+	require.NoError(t, err)
+	assert.NotContains(t, keys(seeded), "/settings/apps/gc2test/v1/store/password")
+	ok, _ = store.Exists(ctx, "settings/apps/gc2test/v1/store/password")
+	assert.False(t, ok)
+}
+
+func TestApplyChanges(t *testing.T) {
+	store := loadKV(t, map[string]string{"settings/apps/gc2test/v1/store/port": "5432"})
+	ctx := context.Background()
+	ch, err := store.WatchTree(ctx, "settings/apps/gc2test/v1/store")
+	require.NoError(t, err)
+	<-ch
+
+	require.NoError(t, ApplyChanges(ctx, map[string]string{"store::host": "db.remote", "store::port": "6543"}))
+	// both keys change at once
+	pairs := <-ch
+	require.Len(t, pairs, 2)
+	assert.Equal(t, pairs[0].LastIndex, pairs[1].LastIndex)
+	assert.Equal(t, "db.remote:6543", GetString("addr"))
+	assert.Equal(t, "kvstore", g2.options["store::host"].lastSetBy)
+
+	// nothing is written when a key or a value is not valid
+	assert.ErrorIs(t, ApplyChanges(ctx, map[string]string{"store::host": "db.local", "store::port": "high"}), ErrInvalidValue)
+	assert.ErrorIs(t, ApplyChanges(ctx, map[string]string{"store::host": "db.local", "nope": "1"}), ErrKeyNotFound)
+	err = ApplyChanges(ctx, map[string]string{"store::password": "new", "store::pass": "old"})
+	assert.EqualError(t, err, "store::pass and store::password: option given more than once")
+	v, _ := store.Get(ctx, "settings/apps/gc2test/v1/store/host")
+	assert.Equal(t, "db.remote", string(v))
+	assert.Equal(t, "db.remote", GetString("store::host"))
+}
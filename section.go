@@ -0,0 +1,100 @@
+package getconf
+
+import (
+	"reflect"
+	"strings"
+)
+
+// section represents a pointer to struct field in the config struct. Its options are
+// tracked as a whole so a nil pointer means that none of them has been given a value.
+type section struct {
+	parent  string        // enclosing section, if any
+	base    reflect.Value // struct holding the field when it is not reached through parent
+	index   []int         // index of the pointer field, relative to base or to the parent struct
+	present bool          // some option in the section has been set by a loader
+}
+
+// parseCtx holds the position of the struct being parsed relative to its section so
+// the section pointers can be allocated later on.
+type parseCtx struct {
+	section string
+	base    reflect.Value
+	index   []int
+}
+
+// field returns the context for the nested struct at field i.
+func (c parseCtx) field(i int) parseCtx {
+	return parseCtx{
+		section: c.section,
+		base:    c.base,
+		index:   append(append([]int{}, c.index...), i),
+	}
+}
+
+// isStructType returns true if t is a struct or a pointer to struct.
+func isStructType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// addSection registers the pointer to struct at field i of the struct described by ctx. Its
+// name is built from prefix, the prefix used for its variables. The section name is returned.
+func (gc *GetConf) addSection(prefix string, ctx parseCtx, i int) string {
+	name := strings.TrimSuffix(prefix, gc.keyDelim)
+	c := ctx.field(i)
+	gc.sections[name] = &section{parent: ctx.section, base: c.base, index: c.index}
+	return name
+}
+
+// markSection sets the section name and its parents as present, allocating their pointers
+// in the config struct when they are nil.
+func (gc *GetConf) markSection(name string) {
+	gc.secMu.Lock()
+	defer gc.secMu.Unlock()
+	gc.allocSection(name)
+}
+
+// allocSection returns the struct value pointed by section name, allocating it if needed. The
+// returned value is invalid when the struct can not be reached or set.
+func (gc *GetConf) allocSection(name string) reflect.Value {
+	s, ok := gc.sections[name]
+	if !ok {
+		return reflect.Value{}
+	}
+	s.present = true
+	base := s.base
+	if s.parent != "" {
+		if pv := gc.allocSection(s.parent); !base.IsValid() {
+			base = pv
+		}
+	}
+	if !base.IsValid() {
+		return reflect.Value{}
+	}
+	f := base.FieldByIndex(s.index)
+	if f.IsNil() {
+		if !f.CanSet() {
+			return reflect.Value{}
+		}
+		f.Set(reflect.New(f.Type().Elem()))
+	}
+	return f.Elem()
+}
+
+// HasSection returns true if any option in the section name has been set by the environment,
+// flags, the kv store or the user. A section is defined by a pointer to struct in the config
+// struct and its name is the prefix of its options without the trailing delimiter (ex: "tls").
+//
+// When a section becomes present, its pointer is allocated in the config struct passed to Load
+// so a nil pointer means that the whole section was absent.
+func HasSection(name string) bool { return g2.HasSection(name) }
+func (gc *GetConf) HasSection(name string) bool {
+	gc.secMu.Lock()
+	defer gc.secMu.Unlock()
+	if s, ok := gc.sections[name]; ok {
+		return s.present
+	}
+	return false
+}
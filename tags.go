@@ -17,6 +17,10 @@ import (
 //      element in the tag
 //    * default: default value of the variable
 //    * info: document the purpose of the variable
+//    * alias: another name for the variable. Can be repeated
+//    * deprecated: an old name for the variable. Using it emits a DeprecationWarning. Can be repeated
+//    * prefix: only for nested structs. The prefix used to name its variables. Empty flattens it
+//    * squash: only for nested structs. Flattens its variables into the parent namespace
 //    * - : a dash should be the only element in the tag. Discards the variable
 //
 // getconf tags are comma separated so no comma is allowed in the options. If a name is not
@@ -41,7 +45,7 @@ func parseTags(t reflect.StructField, o *Option, prefix string) error {
 			k := strings.Split(opts, ",")
 
 			for _, sk := range k {
-				if sk == "" {
+				if sk = strings.TrimSpace(sk); sk == "" || sk == "squash" {
 					continue
 				}
 				key, value := getKeyValFromTagOption(sk)
@@ -49,10 +53,15 @@ func parseTags(t reflect.StructField, o *Option, prefix string) error {
 				case "default":
 					o.defValue = value
 					o.value = getTypedValue(o.defValue, o.oType)
+					o.raw = o.defValue
 					o.updatedAt = time.Now().UTC()
 					o.lastSetBy = "default"
 				case "info":
 					o.usage = value
+				case "alias":
+					o.aliases = append(o.aliases, strings.ToLower(prefix+value))
+				case "deprecated":
+					o.deprecated = append(o.deprecated, strings.ToLower(prefix+value))
 				}
 			}
 		}
@@ -60,6 +69,35 @@ func parseTags(t reflect.StructField, o *Option, prefix string) error {
 	return nil
 }
 
+// nestedPrefix returns the prefix to be used for the variables of the nested struct in t.
+//
+// named is the prefix built from the field name (or the tag name) and parent the prefix of the
+// struct holding t. Embedded structs without a name in the tag use parent so they get flattened,
+// as do structs with the squash option. A prefix option overrides both.
+func nestedPrefix(t reflect.StructField, named, parent, keyDelim string) string {
+	tag := strings.TrimSpace(t.Tag.Get("getconf"))
+	name, opts := parseTag(tag)
+	p := named
+	if t.Anonymous && strings.TrimSpace(name) == "" {
+		p = parent
+	}
+	for _, sk := range strings.Split(opts, ",") {
+		sk = strings.TrimSpace(sk)
+		if sk == "squash" {
+			p = parent
+			continue
+		}
+		if strings.HasPrefix(sk, "prefix") && strings.Contains(sk, ":") {
+			if _, value := getKeyValFromTagOption(sk); value != "" {
+				p = strings.ToLower(parent + value + keyDelim)
+			} else {
+				p = parent
+			}
+		}
+	}
+	return p
+}
+
 // getKeyValFromTagOption returns the key, value pair that can be extracted
 // from opt.
 //
@@ -24,10 +24,10 @@ func (gc *GetConf) GetAll() map[string]interface{} {
 }
 
 // Get return the value associated to the key even if it is a
-// default value or nil
+// default value or nil. key can also be an alias or a deprecated name
 func Get(key string) interface{} { return g2.Get(key) }
 func (gc *GetConf) Get(key string) interface{} {
-	if o, ok := gc.options[key]; ok != false {
+	if o, ok := gc.options[gc.resolveKey(key)]; ok != false {
 		return o.value
 	}
 	return nil
@@ -231,6 +231,45 @@ func getTypedValue(opt string, t reflect.Kind) interface{} {
 	return nil
 }
 
+// checkTypedValue returns ErrInvalidValue if opt can not be converted to the type t, where
+// getTypedValue would return the zero value of the type.
+func checkTypedValue(opt string, t reflect.Kind) error {
+	var err error
+	switch t {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		_, err = strconv.ParseInt(opt, 10, bitSize(t))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		_, err = strconv.ParseUint(opt, 10, bitSize(t))
+	case reflect.Float32, reflect.Float64:
+		_, err = strconv.ParseFloat(opt, bitSize(t))
+	case reflect.Bool:
+		_, err = strconv.ParseBool(opt)
+	case reflect.Struct:
+		if _, err = StringToDate(opt); err != nil {
+			_, err = strconv.ParseInt(opt, 10, 64)
+		}
+	}
+	if err != nil {
+		return ErrInvalidValue
+	}
+	return nil
+}
+
+// bitSize returns the size in bits of the numeric kind t, 0 for int and uint
+func bitSize(t reflect.Kind) int {
+	switch t {
+	case reflect.Int8, reflect.Uint8:
+		return 8
+	case reflect.Int16, reflect.Uint16:
+		return 16
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 32
+	case reflect.Int64, reflect.Uint64, reflect.Float64:
+		return 64
+	}
+	return 0
+}
+
 // From https://github.com/spf13/cast/blob/master/caste.go
 // Copyright © 2014 Steve Francia <spf@spf13.com>.
 // StringToDate attempts to parse a string into a time.Time type using a